@@ -1,10 +1,9 @@
 package main
 
 import (
-	"database/sql"
 	"github.com/go-on/pj"
+	"github.com/go-on/pj/pjpgx"
 	"github.com/jackc/pgx"
-	"github.com/jackc/pgx/stdlib"
 	"net/http"
 	"os"
 )
@@ -38,9 +37,9 @@ func init() {
 
 func run() (err error) {
 	var (
-		conf pgx.ConnConfig
-		pool *pgx.ConnPool
-		db   *sql.DB
+		conf    pgx.ConnConfig
+		pool    *pgx.ConnPool
+		backend *pjpgx.Backend
 	)
 
 steps:
@@ -53,10 +52,12 @@ steps:
 		case 1:
 			pool, err = pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: conf})
 		case 2:
-			db, err = stdlib.OpenFromConnPool(pool)
+			backend = pjpgx.New(pool)
 		case 3:
 			for p, m := range queries {
-				http.Handle("/"+p, pj.New(db, m, printErr))
+				h := pj.New(nil, m, printErr)
+				h.Backend = backend
+				http.Handle("/"+p, h)
 			}
 			http.ListenAndServe(":8080", nil)
 		}
@@ -78,7 +79,7 @@ CREATE OR REPLACE FUNCTION all_persons(params json) RETURNS text AS $function$
   o["http_status_code"] = 201;
   o["http_headers"] = {"last-mod": "now"};
   return JSON.stringify(o);
-$function$ LANGUAGE plv8 IMMUTABLE STRICT;
+$function$ LANGUAGE plv8 STABLE STRICT;
 */
 
 func main() {
@@ -0,0 +1,178 @@
+package pj
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Backend calls the query functions for the http handlers. If the Backend of a PJ is nil,
+// the query functions are called via its Queryer. See the package github.com/go-on/pj/pjpgx
+// for a Backend that uses a pgx connection pool without the overhead of database/sql.
+type Backend interface {
+	// Call calls the query function fn with the json params and returns its result.
+	// It returns nil, if the query function returned NULL.
+	Call(ctx context.Context, fn string, params []byte) ([]byte, error)
+}
+
+// StmtCache is implemented by Backends that cache a prepared statement per query function.
+// The QueryCollection invalidates the statement of a query function in the Backend and in the Backends
+// of the Replicas, when it is updated or removed.
+type StmtCache interface {
+	// Invalidate removes the prepared statement of the query function fn from the cache
+	Invalidate(fn string)
+}
+
+// QueryerBackend is the Backend that calls the query functions via a Queryer, e.g. a *sql.DB.
+// If the Queryer has a QueryRowContext method, the context is passed to it.
+// The params are passed as string and the result is scanned as []byte, so that database/sql drivers
+// handle json, jsonb and text alike.
+//
+// If the QueryerBackend has been created by NewQueryerBackend and the Queryer has a PrepareContext method,
+// a statement is prepared for each query function on first use and reused afterwards.
+// For a *sql.DB the statement is prepared on each pooled connection when it is first used on it.
+type QueryerBackend struct {
+	Queryer Queryer
+
+	mu    sync.RWMutex
+	stmts map[string]*cachedStmt // nil, if statements are not cached
+}
+
+type cachedStmt struct {
+	*sql.Stmt
+	closed bool // guarded by the mutex of the QueryerBackend
+}
+
+type queryRowContexter interface {
+	QueryRowContext(ctx context.Context, sql string, args ...interface{}) *sql.Row
+}
+
+type contextPreparer interface {
+	PrepareContext(ctx context.Context, sql string) (*sql.Stmt, error)
+}
+
+var (
+	_ StmtCache = &QueryerBackend{}
+	_ Pinger    = &QueryerBackend{}
+)
+
+// NewQueryerBackend returns a QueryerBackend that caches the prepared statements of the query functions
+func NewQueryerBackend(q Queryer) *QueryerBackend {
+	return &QueryerBackend{Queryer: q, stmts: map[string]*cachedStmt{}}
+}
+
+// stmt returns the prepared statement for the query function fn. It returns nil, if statements
+// are not cached or can't be prepared by the Queryer.
+func (q *QueryerBackend) stmt(ctx context.Context, fn string) (*cachedStmt, error) {
+	pr, ok := q.Queryer.(contextPreparer)
+	if !ok {
+		return nil, nil
+	}
+
+	q.mu.RLock()
+	if q.stmts == nil {
+		q.mu.RUnlock()
+		return nil, nil
+	}
+	st, has := q.stmts[fn]
+	q.mu.RUnlock()
+	if has {
+		return st, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if st, has = q.stmts[fn]; has {
+		return st, nil
+	}
+
+	s, err := pr.PrepareContext(ctx, "SELECT "+fn+"($1)")
+	if err != nil {
+		return nil, err
+	}
+	st = &cachedStmt{Stmt: s}
+	q.stmts[fn] = st
+	return st, nil
+}
+
+// isClosed reports whether the statement has been closed by Invalidate
+func (q *QueryerBackend) isClosed(st *cachedStmt) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return st.closed
+}
+
+// Call calls the query function fn with the json params
+func (q *QueryerBackend) Call(ctx context.Context, fn string, params []byte) (result []byte, err error) {
+	st, err := q.stmt(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if st != nil {
+		err = st.QueryRowContext(ctx, string(params)).Scan(&result)
+		if err == nil || !q.isClosed(st) {
+			return
+		}
+		// the statement has been invalidated while it was used, try again with a new one
+		return q.Call(ctx, fn, params)
+	}
+
+	var row *sql.Row
+	if qc, ok := q.Queryer.(queryRowContexter); ok {
+		row = qc.QueryRowContext(ctx, "SELECT "+fn+"($1)", string(params))
+	} else {
+		row = q.Queryer.QueryRow("SELECT "+fn+"($1)", string(params))
+	}
+	err = row.Scan(&result)
+	return
+}
+
+// Invalidate closes the prepared statement of the query function fn and removes it from the cache
+func (q *QueryerBackend) Invalidate(fn string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if st, has := q.stmts[fn]; has {
+		st.closed = true
+		st.Close()
+		delete(q.stmts, fn)
+	}
+}
+
+// Ping checks the connection to the database, if the Queryer has a PingContext method, e.g. a *sql.DB
+func (q *QueryerBackend) Ping(ctx context.Context) error {
+	if p, ok := q.Queryer.(interface{ PingContext(context.Context) error }); ok {
+		return p.PingContext(ctx)
+	}
+	return nil
+}
+
+// backend returns the Backend of p
+func (p *PJ) backend() Backend {
+	if p.Backend != nil {
+		return p.Backend
+	}
+	return &QueryerBackend{Queryer: p.Queryer}
+}
+
+// invalidate invalidates the prepared statement of the query function fn of the handler of the mount path mntp
+// in the Backend of the primary and in the Backends of the Replicas
+func (q *QueryCollection) invalidate(mntp, fn string) {
+	pj, has := q.Handlers[mntp]
+	if !has {
+		return
+	}
+	if c, ok := pj.backend().(StmtCache); ok {
+		c.Invalidate(fn)
+	}
+	if pj.Replicas == nil {
+		return
+	}
+	for _, b := range pj.Replicas.Backends {
+		if c, ok := b.(StmtCache); ok {
+			c.Invalidate(fn)
+		}
+	}
+}
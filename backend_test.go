@@ -0,0 +1,75 @@
+package pj
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestQueryerBackendStmtCache(t *testing.T) {
+	const query = "SELECT pj__cached__get($1)"
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		query: testResult(`{"result":1}`),
+	})
+
+	b := NewQueryerBackend(db)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		res, err := b.Call(ctx, "pj__cached__get", []byte(`{}`))
+		if err != nil {
+			t.Fatalf("Call() returned error: %s", err)
+		}
+		if got, want := string(res), `{"result":1}`; got != want {
+			t.Errorf("Call() = %#v; want %#v", got, want)
+		}
+	}
+
+	testDrv.Lock()
+	prepared := testDrv.prepared[query]
+	testDrv.results[query] = testResult(`{"result":2}`)
+	testDrv.Unlock()
+
+	if got, want := prepared, 1; got != want {
+		t.Errorf("statement prepared %d times; want %d", got, want)
+	}
+
+	// the cached statement still calls the old function
+	res, _ := b.Call(ctx, "pj__cached__get", []byte(`{}`))
+	if got, want := string(res), `{"result":1}`; got != want {
+		t.Errorf("Call() before Invalidate = %#v; want %#v", got, want)
+	}
+
+	b.Invalidate("pj__cached__get")
+
+	res, _ = b.Call(ctx, "pj__cached__get", []byte(`{}`))
+	if got, want := string(res), `{"result":2}`; got != want {
+		t.Errorf("Call() after Invalidate = %#v; want %#v", got, want)
+	}
+}
+
+// invalidatedBackend is a Backend that records the invalidated statements
+type invalidatedBackend struct {
+	testBackend
+	invalidated []string
+}
+
+func (b *invalidatedBackend) Invalidate(fn string) { b.invalidated = append(b.invalidated, fn) }
+
+func TestInvalidateReplicas(t *testing.T) {
+	primary, replica := &invalidatedBackend{}, &invalidatedBackend{}
+
+	p := New(nil, map[string]string{"GET": "pj__all_persons__get"}, nil)
+	p.Backend = primary
+	p.Replicas = &Replicas{Backends: []Backend{testBackend{name: "r1"}, replica}}
+
+	q := &QueryCollection{Handlers: map[string]*PJ{"persons": p}}
+	q.invalidate("persons", "pj__all_persons__get")
+
+	for name, b := range map[string]*invalidatedBackend{"primary": primary, "replica": replica} {
+		if got, want := strings.Join(b.invalidated, ","), "pj__all_persons__get"; got != want {
+			t.Errorf("invalidated statements of the %s = %#v; want %#v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// mux is a pj.Muxer that serves the http.Handlers by their mount paths
+type mux struct {
+	handlers map[string]http.Handler
+	sync.RWMutex
+}
+
+func newMux() *mux {
+	return &mux{handlers: map[string]http.Handler{}}
+}
+
+func (m *mux) Handle(path string, h http.Handler) {
+	m.Lock()
+	m.handlers[path] = h
+	m.Unlock()
+}
+
+func (m *mux) RemoveHandler(path string) {
+	m.Lock()
+	delete(m.handlers, path)
+	m.Unlock()
+}
+
+func (m *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.RLock()
+	h, has := m.handlers[strings.Trim(r.URL.Path, "/")]
+	m.RUnlock()
+	if !has {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
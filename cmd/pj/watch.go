@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-on/pj"
+	"gopkg.in/fsnotify.v1"
+)
+
+// watch watches the root directory of the given QueryCollection and its subdirectories
+// and adds, updates and removes the query functions when their files change
+func watch(qc *pj.QueryCollection, m pj.Muxer, db *sql.DB) (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(qc.RootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.Add(path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				err := handleEvent(qc, m, db, w, ev)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s: %s\n", ev.Name, err.Error())
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(os.Stderr, "Error: watcher: %s\n", err.Error())
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func handleEvent(qc *pj.QueryCollection, m pj.Muxer, db *sql.DB, w *fsnotify.Watcher, ev fsnotify.Event) error {
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			return w.Add(ev.Name)
+		}
+	}
+
+	rel, err := filepath.Rel(qc.RootDir, ev.Name)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Base(rel) == pj.MountConfigFile {
+		fmt.Printf("updating %s\n", rel)
+		return qc.UpdateMountConfig(m, filepath.ToSlash(filepath.Dir(rel)))
+	}
+
+	if strings.HasPrefix(filepath.ToSlash(rel), pj.LibDir+"/") {
+		if !strings.HasSuffix(ev.Name, ".js") {
+			return nil
+		}
+		fmt.Printf("updating %s and the query functions requiring it\n", rel)
+		return qc.UpdateLib(db, rel)
+	}
+
+	if !strings.HasSuffix(ev.Name, ".sql") {
+		return nil
+	}
+
+	switch {
+	case ev.Op&fsnotify.Create == fsnotify.Create:
+		fmt.Printf("adding %s\n", rel)
+		return qc.AddQuery(m, db, rel)
+	case ev.Op&fsnotify.Write == fsnotify.Write:
+		fmt.Printf("updating %s\n", rel)
+		return qc.UpdateQuery(m, db, rel)
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		fmt.Printf("removing %s\n", rel)
+		return qc.RemoveQuery(m, db, rel)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package pj
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// MountConfigFile is the name of the optional config file inside a mount path directory
+const MountConfigFile = "pj.json"
+
+// MountConfig is the configuration of a mount path. It is read from the MountConfigFile
+// inside the directory of the mount path, e.g. persons/pj.json:
+//
+//	{
+//	  "cors": {"allow_origins": ["https://example.com"], "allow_credentials": true},
+//	  "max_body_size": 4096,
+//	  "limits": {"rate": 10, "burst": 20, "max_in_flight": 4, "max_queue": 16},
+//	  "endpoints": {
+//	    "GET": {"pagination": {"default_limit": 20, "max_limit": 100}, "signature": {"params": "jsonb", "returns": "jsonb"}},
+//	    "POST": {"max_body_size": 10485760}
+//	  }
+//	}
+//
+// Settings of the MountConfig override the settings of the QueryCollection.
+// The Endpoint settings may also be given in the header of a query function file, see FuncHeader.
+type MountConfig struct {
+	// CORS is the CORS policy for the mount path
+	CORS *CORS `json:"cors"`
+
+	// MaxBodySize is the max size of request bodies for the mount path, if > 0
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// Limits are the Limits for all methods of the mount path, if not nil
+	Limits *Limits `json:"limits"`
+
+	// Endpoints are the settings of the query functions, keyed by request method
+	Endpoints map[string]*Endpoint `json:"endpoints"`
+}
+
+// readMountConfig reads the MountConfigFile of the mount path mntp from the file system.
+// It returns nil, if there is no MountConfigFile.
+func readMountConfig(fsys fs.FS, mntp string) (*MountConfig, error) {
+	f := path.Join(mntp, MountConfigFile)
+	b, err := fs.ReadFile(fsys, f)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c MountConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, errors.New("invalid " + f + ": " + err.Error())
+	}
+
+	if c.CORS != nil {
+		if err = c.CORS.validate(); err != nil {
+			return nil, errors.New("invalid " + f + ": " + err.Error())
+		}
+	}
+
+	endpoints := make(map[string]*Endpoint, len(c.Endpoints))
+	for meth, e := range c.Endpoints {
+		switch m := strings.ToUpper(meth); m {
+		case "GET", "POST", "PUT", "PATCH", "DELETE":
+			if e != nil {
+				if err := validateEndpoint(e); err != nil {
+					return nil, errors.New("invalid " + f + ": " + err.Error())
+				}
+			}
+			endpoints[m] = e
+		default:
+			return nil, errors.New("invalid " + f + ": method " + meth + " is not allowed")
+		}
+	}
+	c.Endpoints = endpoints
+	return &c, nil
+}
+
+// validateEndpoint returns an error, if the Signature or the Volatility of the Endpoint e is invalid
+func validateEndpoint(e *Endpoint) error {
+	if e.Signature != nil {
+		if err := e.Signature.validate(); err != nil {
+			return err
+		}
+	}
+	switch strings.ToUpper(e.Volatility) {
+	case "", Volatile, Stable, Immutable:
+	default:
+		return errors.New("volatility " + e.Volatility + " is not allowed")
+	}
+	return nil
+}
+
+// configure applies the settings of the QueryCollection and of the MountConfig of the mount path mntp
+// to the handler pj
+func (q *QueryCollection) configure(pj *PJ, mntp string) error {
+	if q.CORS != nil {
+		if err := q.CORS.validate(); err != nil {
+			return err
+		}
+	}
+	pj.MaxBodySize = q.maxBodySize
+	pj.CORS = q.CORS
+	pj.ErrorRenderer = q.ErrorRenderer
+	pj.Hardened = q.Hardened
+	if q.Backend != nil {
+		pj.Backend = q.Backend
+	}
+	pj.Limits = q.Limits
+	pj.Replicas = q.Replicas
+	pj.Retry = q.Retry
+	pj.ExposeDBError = q.ExposeDBError
+	pj.ClientID = q.ClientID
+	pj.QueueObserver = q.QueueObserver
+	pj.Endpoints = nil
+
+	if q.FS == nil {
+		return nil
+	}
+
+	c, err := readMountConfig(q.FS, mntp)
+	if err != nil {
+		return err
+	}
+
+	endpoints := map[string]*Endpoint{}
+	if c != nil {
+		if c.CORS != nil {
+			pj.CORS = c.CORS
+		}
+		if c.MaxBodySize > 0 {
+			pj.MaxBodySize = c.MaxBodySize
+		}
+		if c.Limits != nil {
+			pj.Limits = c.Limits
+		}
+		for meth, e := range c.Endpoints {
+			endpoints[meth] = e
+		}
+	}
+
+	// the headers of the query function files override the MountConfig
+	for meth := range q.Queries[mntp] {
+		h, err := q.header(mntp, meth)
+		if err != nil {
+			return err
+		}
+		if h != nil {
+			endpoints[meth] = endpoints[meth].merge(&h.Endpoint)
+		}
+	}
+
+	if len(endpoints) > 0 {
+		pj.Endpoints = endpoints
+	}
+	return nil
+}
+
+// UpdateMountConfig rereads the MountConfigFile of the mount path mntp and replaces the http handler
+// of the mount path by a new one with the config. It does nothing, if the mount path has no http handler.
+func (q *QueryCollection) UpdateMountConfig(mux Muxer, mntp string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if _, has := q.Handlers[mntp]; !has {
+		return nil
+	}
+	return q.swap(mux, mntp)
+}
@@ -0,0 +1,96 @@
+package pj
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS is the policy for cross origin requests, see https://fetch.spec.whatwg.org/#http-cors-protocol
+type CORS struct {
+	// AllowOrigins are the origins that are allowed to access the resource, e.g. https://example.com.
+	// The origin "*" allows every origin, it must not be combined with AllowCredentials.
+	AllowOrigins []string `json:"allow_origins"`
+
+	// AllowCredentials allows requests with credentials (cookies, authorization headers)
+	AllowCredentials bool `json:"allow_credentials"`
+
+	// AllowHeaders are the request headers that are allowed for preflighted requests.
+	// If empty, the headers requested by the preflight request are allowed.
+	AllowHeaders []string `json:"allow_headers"`
+
+	// ExposeHeaders are the response headers that are exposed to the client
+	ExposeHeaders []string `json:"expose_headers"`
+
+	// MaxAge is the number of seconds the result of a preflight request may be cached. 0 means not set.
+	MaxAge int `json:"max_age"`
+}
+
+// validate returns an error, if the origin "*" is combined with AllowCredentials, since that would
+// allow every site to make requests with the credentials of the user
+func (c *CORS) validate() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			return errors.New("cors: the origin * must not be combined with allow_credentials")
+		}
+	}
+	return nil
+}
+
+// allowOrigin returns the value for the Access-Control-Allow-Origin header for the given origin
+// or an empty string, if the origin is not allowed. The origin "*" never allows requests with credentials.
+func (c *CORS) allowOrigin(origin string) string {
+	for _, o := range c.AllowOrigins {
+		switch {
+		case o == "*" && !c.AllowCredentials:
+			return "*"
+		case o == origin:
+			return origin
+		}
+	}
+	return ""
+}
+
+// setHeaders sets the CORS headers of the response to the request r. allow is the list of the allowed methods
+// that is used to answer preflight requests. It returns false, if the request has no origin or the origin
+// is not allowed.
+func (c *CORS) setHeaders(h http.Header, r *http.Request, allow string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	h.Add("Vary", "Origin")
+	ao := c.allowOrigin(origin)
+	if ao == "" {
+		return false
+	}
+
+	h.Set("Access-Control-Allow-Origin", ao)
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		if len(c.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+		return true
+	}
+
+	// preflight request
+	h.Set("Access-Control-Allow-Methods", allow)
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	} else if rh := r.Header.Get("Access-Control-Request-Headers"); rh != "" {
+		h.Set("Access-Control-Allow-Headers", rh)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	return true
+}
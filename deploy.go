@@ -0,0 +1,190 @@
+package pj
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// probeOK is the SQLSTATE that is raised after a successful probe to roll back its effects
+const probeOK = "PJ000"
+
+// DeployError is returned if a query function could not be deployed or failed its probe.
+// Line is the line within the query function file, 0 if the error is not related to a line
+// of the file.
+type DeployError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (d *DeployError) Error() string {
+	if d.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", d.File, d.Err.Error())
+}
+
+// bodyLineOffset is the number of lines that FuncSource puts in front of the content of the file
+var bodyLineOffset = strings.Count(strings.SplitN(FuncSource([]byte("\x00")), "\x00", 2)[0], "\n")
+
+// plv8Line matches the line reported by plv8 within the context of an error, e.g. "pj__all_persons__get() LINE 9:   var x = ;"
+var plv8Line = regexp.MustCompile(`LINE (\d+):\s?(.*)`)
+
+// fileLine translates the line reported by plv8 inside the error context back into the line of the
+// query function file with the content fbody. Since plv8 may count the lines of its own function wrapper,
+// the reported source line is looked up around the calculated line. It returns 0, if the line is
+// not part of the file.
+func fileLine(fbody []byte, pe *PgError) int {
+	m := plv8Line.FindStringSubmatch(pe.Where)
+	if m == nil {
+		m = plv8Line.FindStringSubmatch(pe.Message)
+	}
+	if m == nil {
+		return 0
+	}
+
+	l, _ := strconv.Atoi(m[1])
+	l -= bodyLineOffset
+
+	lines := strings.Split(string(fbody), "\n")
+	src := strings.TrimSpace(m[2])
+	if src != "" {
+		for _, d := range []int{0, -1, 1} {
+			if i := l + d; i >= 1 && i <= len(lines) && strings.TrimSpace(lines[i-1]) == src {
+				return i
+			}
+		}
+	}
+
+	if l < 1 || l > len(lines) {
+		return 0
+	}
+	return l
+}
+
+// deployError wraps an error of the db while deploying the query function file into a *DeployError
+func deployError(file string, fbody []byte, err error) error {
+	de := &DeployError{File: file, Err: err}
+	if pe := pgError(err); pe != nil {
+		de.Line = fileLine(fbody, pe)
+		if pe.Where != "" {
+			de.Err = fmt.Errorf("%s (%s)", err.Error(), pe.Where)
+		}
+	}
+	return de
+}
+
+// probe calls the postgres function fn with the given json params inside a DO block that is
+// always rolled back by raising probeOK, so that the probe has no effects. probeOK is caught
+// inside the DO block, so that the probe does not abort the surrounding transaction.
+func probe(db Execer, fn string, sig Signature, params string) error {
+	_, err := db.Exec(fmt.Sprintf(`DO $probe$ BEGIN
+	BEGIN
+		PERFORM %s(%s::%s);
+		RAISE EXCEPTION 'probe ok' USING ERRCODE = '%s';
+	EXCEPTION WHEN SQLSTATE '%s' THEN
+		NULL;
+	END;
+END $probe$`, fn, quoteLiteral(params), sig.withDefaults().Params, probeOK, probeOK))
+	return err
+}
+
+// beginner is implemented by databases that start transactions, e.g. *sql.DB
+type beginner interface {
+	Begin() (*sql.Tx, error)
+}
+
+// quoteLiteral returns s as a quoted sql string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// deployFile reads the query function file and creates or replaces the postgres function of it.
+// Functions of the same name with another Signature are dropped before.
+// If the QueryCollection has ProbeParams, the function is probed with them afterwards.
+// If db starts transactions, all statements run inside one transaction that is rolled back on errors,
+// otherwise they run directly on db, e.g. inside a transaction of the caller.
+// mods are the modules of the LibDir.
+// It returns the statements that have been executed, or would have been executed, if dryRun is true.
+func (q *QueryCollection) deployFile(db DB, file, meth, fname string, mods map[string]*libModule, dryRun bool) (stmt string, err error) {
+	var c []byte
+	c, err = fs.ReadFile(q.FS, file)
+	if err != nil {
+		return
+	}
+
+	mntp, _, _, err := splitRelPath(file)
+	if err != nil {
+		return
+	}
+
+	h, err := parseHeader(c)
+	if err != nil {
+		return "", &DeployError{File: file, Err: err}
+	}
+
+	sig, err := q.signature(mntp, meth, h)
+	if err != nil {
+		return "", &DeployError{File: file, Err: err}
+	}
+
+	h, err = q.withMountConfig(mntp, meth, h)
+	if err != nil {
+		return "", &DeployError{File: file, Err: err}
+	}
+
+	versions, err := deps(mods, c)
+	if err != nil {
+		return "", &DeployError{File: file, Err: err}
+	}
+
+	drop := dropFuncs(FuncName(meth, fname), &sig)
+	create := sig.sql(meth, fname, c, h, versions)
+	stmt = drop + "\n" + create
+	if dryRun {
+		return
+	}
+
+	var ex Execer = db
+	if b, ok := db.(beginner); ok {
+		var tx *sql.Tx
+		tx, err = b.Begin()
+		if err != nil {
+			return stmt, &DeployError{File: file, Err: err}
+		}
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+				return
+			}
+			if err = tx.Commit(); err != nil {
+				err = deployError(file, c, err)
+			}
+		}()
+		ex = tx
+	}
+
+	_, err = ex.Exec(drop)
+	if err != nil {
+		return stmt, deployError(file, c, err)
+	}
+
+	_, err = ex.Exec(create)
+	if err != nil {
+		return stmt, deployError(file, c, err)
+	}
+
+	if q.ProbeParams == "" {
+		return
+	}
+
+	err = probe(ex, FuncName(meth, fname), sig, q.ProbeParams)
+	if err != nil {
+		return stmt, deployError(file, c, err)
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package pj
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+type testDriverError struct {
+	Code    string
+	Message string
+	Where   string
+}
+
+func (t testDriverError) Error() string { return t.Message }
+
+func TestDeployError(t *testing.T) {
+	fbody := []byte("var a = 1;\nvar b = ;\nresponse.results.push(a);")
+
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{errors.New("connection refused"), "x.sql: connection refused"},
+		{testDriverError{"42P13", "SyntaxError: Unexpected token ;", "undefined() LINE 9: var b = ;"}, "x.sql:2: SyntaxError: Unexpected token ; (undefined() LINE 9: var b = ;)"},
+		{testDriverError{"XX000", "SyntaxError: Unexpected token ;", "undefined() LINE 10: var b = ;"}, "x.sql:2: SyntaxError: Unexpected token ; (undefined() LINE 10: var b = ;)"},
+		{testDriverError{"XX000", "Error: boom", "pj__x__get() LINE 1: if (typeof params != 'object')"}, "x.sql: Error: boom (pj__x__get() LINE 1: if (typeof params != 'object'))"},
+	}
+
+	for _, test := range tests {
+		if got, want := deployError("x.sql", fbody, test.err).Error(), test.expected; got != want {
+			t.Errorf("deployError(%#v) = %#v; want %#v", test.err, got, want)
+		}
+	}
+}
+
+func TestDeployTransaction(t *testing.T) {
+	fsys := fstest.MapFS{
+		"persons/get/all_persons.sql": {Data: []byte(`/* pj: {"role": "editor"} */
+response.results = [];`)},
+	}
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	stmts, err := q.RegisterQueryFuncs(nil, true)
+	if err != nil {
+		t.Fatalf("RegisterQueryFuncs(nil, true) returned error: %s", err)
+	}
+	i := strings.Index(stmts[0], "\n\nCREATE OR REPLACE FUNCTION")
+	if i < 0 {
+		t.Fatalf("unexpected statement %#v", stmts[0])
+	}
+	drop, create := stmts[0][:i], stmts[0][i+1:]
+
+	for _, fail := range []bool{false, true} {
+		db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+			drop: testResult(""),
+			create: func(args []driver.Value) ([]byte, error) {
+				if fail {
+					return nil, errors.New(`role "editor" does not exist`)
+				}
+				return nil, nil
+			},
+		})
+
+		testDrv.Lock()
+		commits, rollbacks := testDrv.commits, testDrv.rollbacks
+		testDrv.Unlock()
+
+		_, err = q.deployFile(db, "persons/get/all_persons.sql", "GET", "all_persons", nil, false)
+
+		testDrv.Lock()
+		commits, rollbacks = testDrv.commits-commits, testDrv.rollbacks-rollbacks
+		testDrv.Unlock()
+
+		if _, ok := err.(*DeployError); fail != ok {
+			t.Errorf("deployFile() with failing create returned %v", err)
+		}
+
+		if fail && (commits != 0 || rollbacks != 1) {
+			t.Errorf("failing deployFile(): %d commits, %d rollbacks; want 0, 1", commits, rollbacks)
+		}
+
+		if !fail && (commits != 1 || rollbacks != 0) {
+			t.Errorf("deployFile(): %d commits, %d rollbacks; want 1, 0", commits, rollbacks)
+		}
+	}
+}
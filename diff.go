@@ -0,0 +1,386 @@
+package pj
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// FuncAdded is the kind of a FuncDiff for a query function that is not deployed
+	FuncAdded = "added"
+
+	// FuncChanged is the kind of a FuncDiff for a query function whose deployed definition differs from its file
+	FuncChanged = "changed"
+
+	// FuncOrphaned is the kind of a FuncDiff for a deployed function without a query function file
+	FuncOrphaned = "orphaned"
+)
+
+// FuncDiff describes the difference between a deployed postgres function and its query function file
+type FuncDiff struct {
+	Kind     string // one of FuncAdded, FuncChanged and FuncOrphaned
+	Function string // name of the postgres function
+	File     string // path of the query function file, empty for FuncOrphaned
+	Diff     string // unified diff between the deployed and the rendered definition, only for FuncChanged
+}
+
+// funcDef is the definition of a pj function, as it is compared by Diff
+type funcDef struct {
+	Src             string   `json:"src"`
+	Params          string   `json:"params"`
+	Returns         string   `json:"returns"`
+	Language        string   `json:"language"`
+	Volatility      string   `json:"volatility"`
+	Strict          bool     `json:"strict"`
+	SecurityDefiner bool     `json:"security_definer"`
+	Leakproof       bool     `json:"leakproof"`
+	Parallel        string   `json:"parallel"`
+	Cost            float64  `json:"cost"`
+	Rows            float64  `json:"rows"`   // the estimated number of rows of set returning functions
+	Config          []string `json:"config"` // the settings of the function, e.g. search_path=public, pg_temp
+	Owner           string   `json:"owner"`
+}
+
+// defaultCost is the cost of functions that are not written in C, if none is given
+const defaultCost = 100
+
+// fileDef returns the funcDef that the query function file with the content fbody is deployed with
+func fileDef(sig Signature, meth string, fbody []byte, h *FuncHeader, versions map[string]string) funcDef {
+	if h == nil {
+		h = &FuncHeader{}
+	}
+	sig = sig.withDefaults()
+	d := funcDef{
+		Src:             sig.funcSource(fbody, versions),
+		Params:          sig.Params,
+		Returns:         sig.Returns,
+		Language:        "plv8",
+		Volatility:      defaultVolatility(meth),
+		Strict:          true,
+		SecurityDefiner: h.SecurityDefiner,
+		Parallel:        "UNSAFE",
+		Cost:            defaultCost,
+		Owner:           h.Role,
+	}
+	if h.Volatility != "" {
+		d.Volatility = strings.ToUpper(h.Volatility)
+	}
+	if h.Parallel != "" {
+		d.Parallel = strings.ToUpper(h.Parallel)
+	}
+	if h.Cost > 0 {
+		d.Cost = h.Cost
+	}
+
+	searchPath := h.SearchPath
+	if searchPath == "" && h.SecurityDefiner {
+		searchPath = DefaultSearchPath
+	}
+	if searchPath != "" {
+		d.Config = []string{"search_path=" + searchPath}
+	}
+	return d
+}
+
+// definition returns the definition of the function with the name fn in a normalized form that
+// resembles the one of pg_get_functiondef, but always contains the parallel safety and the cost
+// and also contains the owner, if it is set
+func (d funcDef) definition(fn string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CREATE OR REPLACE FUNCTION %s\n LANGUAGE %s %s", Signature{Params: d.Params, Returns: d.Returns}.declaration(fn), d.Language, d.Volatility)
+	if d.Strict {
+		b.WriteString(" STRICT")
+	}
+	if d.SecurityDefiner {
+		b.WriteString(" SECURITY DEFINER")
+	}
+	if d.Leakproof {
+		b.WriteString(" LEAKPROOF")
+	}
+	fmt.Fprintf(&b, " PARALLEL %s COST %v", d.Parallel, d.Cost)
+	if d.Rows > 0 {
+		fmt.Fprintf(&b, " ROWS %v", d.Rows)
+	}
+	b.WriteString("\n")
+
+	for _, c := range d.Config {
+		kv := strings.SplitN(c, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		var vals []string
+		for _, v := range strings.Split(kv[1], ",") {
+			vals = append(vals, strings.TrimSpace(v))
+		}
+		fmt.Fprintf(&b, " SET %s = %s\n", kv[0], strings.Join(vals, ", "))
+	}
+
+	if d.Owner != "" {
+		fmt.Fprintf(&b, " OWNER TO %s\n", d.Owner)
+	}
+	fmt.Fprintf(&b, "AS $function$%s$function$\n", d.Src)
+	return b.String()
+}
+
+// deployedFuncsQuery returns the definitions of the pj functions in the current schema as json object,
+// keyed by function name
+var deployedFuncsQuery = `SELECT coalesce(json_object_agg(proname, json_build_object(
+	'src', prosrc,
+	'params', format_type(proargtypes[0], NULL),
+	'returns', format_type(prorettype, NULL),
+	'language', (SELECT lanname FROM pg_language WHERE oid = prolang),
+	'volatility', CASE provolatile WHEN 'i' THEN 'IMMUTABLE' WHEN 's' THEN 'STABLE' ELSE 'VOLATILE' END,
+	'strict', proisstrict,
+	'security_definer', prosecdef,
+	'leakproof', proleakproof,
+	'parallel', CASE proparallel WHEN 's' THEN 'SAFE' WHEN 'r' THEN 'RESTRICTED' ELSE 'UNSAFE' END,
+	'cost', procost,
+	'rows', prorows,
+	'config', proconfig,
+	'owner', pg_get_userbyid(proowner)
+)), '{}')::text FROM pg_proc WHERE proname LIKE 'pj\_\_%' AND pronamespace = current_schema()::regnamespace`
+
+// deployedFuncs returns the definitions of the pj functions deployed in the current schema of the db,
+// keyed by function name
+func deployedFuncs(db Queryer) (map[string]funcDef, error) {
+	var b []byte
+	err := db.QueryRow(deployedFuncsQuery).Scan(&b)
+	if err != nil {
+		return nil, err
+	}
+	var funcs = map[string]funcDef{}
+	err = json.Unmarshal(b, &funcs)
+	return funcs, err
+}
+
+// Diff compares the definitions of the query function files, as they are deployed by RegisterQueryFuncs,
+// with the definitions of the functions that are deployed in the db. The definitions are not compared
+// as text of pg_get_functiondef, but by the following columns of pg_proc, that are rendered in a normalized form:
+//
+//	prosrc, proargtypes, prorettype  the source and the Signature
+//	prolang                          the language
+//	provolatile                      the volatility
+//	proisstrict                      STRICT
+//	prosecdef                        SECURITY DEFINER
+//	proleakproof                     LEAKPROOF
+//	proparallel                      the parallel safety
+//	procost, prorows                 the cost and the estimated rows
+//	proconfig                        all settings, e.g. the search_path
+//	proowner                         the owner, only if the FuncHeader sets a Role
+//
+// It reports functions that are not deployed yet (FuncAdded), functions with a different
+// definition (FuncChanged) including a unified diff and pj functions of the current schema without
+// a query function file (FuncOrphaned). The returned diffs are sorted by function name.
+func (q *QueryCollection) Diff(db Queryer) (diffs []FuncDiff, err error) {
+	if q.FS == nil {
+		return nil, errNoFiles
+	}
+	var deployed map[string]funcDef
+	deployed, err = deployedFuncs(db)
+	if err != nil {
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	mods, err := q.libs()
+	if err != nil {
+		return
+	}
+
+	q.EachFile(func(file, funcname, meth string) {
+		if err != nil {
+			return
+		}
+
+		var c []byte
+		c, err = fs.ReadFile(q.FS, file)
+		if err != nil {
+			return
+		}
+
+		var h *FuncHeader
+		h, err = parseHeader(c)
+		if err != nil {
+			err = &DeployError{File: file, Err: err}
+			return
+		}
+
+		mntp := path.Dir(path.Dir(file))
+		var sig Signature
+		sig, err = q.signature(mntp, meth, h)
+		if err != nil {
+			return
+		}
+
+		h, err = q.withMountConfig(mntp, meth, h)
+		if err != nil {
+			return
+		}
+
+		var versions map[string]string
+		versions, err = deps(mods, c)
+		if err != nil {
+			err = &DeployError{File: file, Err: err}
+			return
+		}
+
+		fn := FuncName(meth, funcname)
+		d, has := deployed[fn]
+		delete(deployed, fn)
+
+		want := fileDef(sig, meth, c, h, versions)
+		if want.Owner == "" {
+			// the owner is only compared, if the header sets it
+			d.Owner = ""
+		}
+
+		switch {
+		case !has:
+			diffs = append(diffs, FuncDiff{Kind: FuncAdded, Function: fn, File: file})
+		case d.definition(fn) != want.definition(fn):
+			diffs = append(diffs, FuncDiff{
+				Kind:     FuncChanged,
+				Function: fn,
+				File:     file,
+				Diff:     unifiedDiff(fn+" (deployed)", file, d.definition(fn), want.definition(fn)),
+			})
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for fn := range deployed {
+		diffs = append(diffs, FuncDiff{Kind: FuncOrphaned, Function: fn})
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Function < diffs[j].Function })
+	return
+}
+
+// unifiedDiff returns the line based difference between a and b in the unified format
+// with three lines of context. It returns an empty string if a and b are equal.
+func unifiedDiff(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	al, bl := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of al[i:] and bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			switch {
+			case al[i] == bl[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+		ai   int // index of the line in a (for ' ' and '-')
+		bi   int // index of the line in b (for ' ' and '+')
+	}
+
+	var lines []line
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			lines = append(lines, line{' ', al[i], i, j})
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', al[i], i, j})
+			i++
+		default:
+			lines = append(lines, line{'+', bl[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+
+	for start := 0; start < len(lines); {
+		// find the next change
+		for start < len(lines) && lines[start].op == ' ' {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// extend the hunk as long as the changes are not further apart than two contexts
+		from, end := start-context, start
+		if from < 0 {
+			from = 0
+		}
+		for k := start; k < len(lines) && k-end <= 2*context; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		to := end + context + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		var na, nb int
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				na++
+			}
+			if l.op != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(lines[from].ai, na), hunkRange(lines[from].bi, nb))
+		for _, l := range lines[from:to] {
+			buf.WriteByte(l.op)
+			buf.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return buf.String()
+}
+
+// splitLines splits s after each newline
+func splitLines(s string) []string {
+	l := strings.SplitAfter(s, "\n")
+	if l[len(l)-1] == "" {
+		l = l[:len(l)-1]
+	}
+	return l
+}
+
+// hunkRange returns the range of a unified diff hunk that starts at the line
+// with the zero based index idx and spans n lines
+func hunkRange(idx, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", idx)
+	}
+	return fmt.Sprintf("%d,%d", idx+1, n)
+}
@@ -0,0 +1,156 @@
+package pj
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/jackc/pgx/stdlib"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+
+	tests := []struct {
+		a, b     string
+		expected string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"a\n", "a\nb\n", "--- a\n+++ b\n@@ -1,1 +1,2 @@\n a\n+b\n"},
+		{"a\nb\n", "b\n", "--- a\n+++ b\n@@ -1,2 +1,1 @@\n-a\n b\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nx\n6\n7\n8\n9\n", "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n"},
+	}
+
+	for _, test := range tests {
+		if got, want := unifiedDiff("a", "b", test.a, test.b), test.expected; got != want {
+			t.Errorf("unifiedDiff(%#v, %#v) = %#v; want %#v", test.a, test.b, got, want)
+		}
+	}
+
+}
+
+func TestDiff(t *testing.T) {
+	fsys := fstest.MapFS{
+		"persons/get/all_persons.sql": {Data: []byte(`/* pj: {"security_definer": true, "cost": 50, "role": "editor"} */
+response.results = [];`)},
+		"persons/post/add_person.sql": {Data: []byte(`response.results = [params];`)},
+	}
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	def := func(meth, file string) funcDef {
+		h, err := parseHeader(fsys[file].Data)
+		if err != nil {
+			t.Fatalf("parseHeader(%s) returned error: %s", file, err)
+		}
+		return fileDef(Signature{}, meth, fsys[file].Data, h, nil)
+	}
+
+	all, add := def("GET", "persons/get/all_persons.sql"), def("POST", "persons/post/add_person.sql")
+	all.Cost = defaultCost
+	add.Owner = "postgres"
+	orphan := add
+
+	b, _ := json.Marshal(map[string]funcDef{"pj__all_persons__get": all, "pj__add_person__post": add, "pj__old__get": orphan})
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		deployedFuncsQuery: testResult(string(b)),
+	})
+
+	diffs, err := q.Diff(db)
+	if err != nil {
+		t.Fatalf("Diff() returned error: %s", err)
+	}
+
+	if got, want := len(diffs), 2; got != want {
+		t.Fatalf("len(Diff()) = %v; want %v: %#v", got, want, diffs)
+	}
+
+	d := diffs[0]
+	if d.Kind != FuncChanged || d.Function != "pj__all_persons__get" {
+		t.Fatalf("Diff()[0] = %#v; want changed pj__all_persons__get", d)
+	}
+	if !strings.Contains(d.Diff, "- LANGUAGE plv8 STABLE STRICT SECURITY DEFINER PARALLEL UNSAFE COST 100\n") ||
+		!strings.Contains(d.Diff, "+ LANGUAGE plv8 STABLE STRICT SECURITY DEFINER PARALLEL UNSAFE COST 50\n") {
+		t.Errorf("Diff() must show the changed cost: %s", d.Diff)
+	}
+
+	if d := diffs[1]; d.Kind != FuncOrphaned || d.Function != "pj__old__get" {
+		t.Errorf("Diff()[1] = %#v; want orphaned pj__old__get", d)
+	}
+}
+
+// TestDiffPostgres needs a postgresql database with plv8, given by the environment variable PG_URL
+func TestDiffPostgres(t *testing.T) {
+	url := os.Getenv("PG_URL")
+	if url == "" {
+		t.Skip("PG_URL not set")
+	}
+
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		t.Fatalf("sql.Open() returned error: %s", err)
+	}
+	defer db.Close()
+
+	q, err := NewQueryCollectionFS(fstest.MapFS{
+		"difftest/get/difftest.sql": {Data: []byte(`/* pj: {"security_definer": true, "cost": 50, "parallel": "safe"} */
+response.results = [];`)},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	const fn = "pj__difftest__get"
+	defer db.Exec("DROP FUNCTION IF EXISTS " + fn + "(json)")
+
+	changed := func() *FuncDiff {
+		diffs, err := q.Diff(db)
+		if err != nil {
+			t.Fatalf("Diff() returned error: %s", err)
+		}
+		for _, d := range diffs {
+			if d.Function == fn {
+				return &d
+			}
+		}
+		return nil
+	}
+
+	alters := []string{
+		"",
+		"VOLATILE",
+		"SECURITY INVOKER",
+		"COST 10",
+		"PARALLEL UNSAFE",
+		"RESET search_path",
+		"SET search_path = public",
+		"SET work_mem = '1MB'",
+	}
+
+	for _, alter := range alters {
+		if _, err = q.RegisterQueryFuncs(db, false); err != nil {
+			t.Fatalf("RegisterQueryFuncs() returned error: %s", err)
+		}
+
+		if alter == "" {
+			if d := changed(); d != nil {
+				t.Errorf("Diff() of the deployed function = %#v; want no diff", d)
+			}
+			continue
+		}
+
+		if _, err = db.Exec("ALTER FUNCTION " + fn + "(params json) " + alter); err != nil {
+			t.Fatalf("ALTER FUNCTION %s returned error: %s", alter, err)
+		}
+		if d := changed(); d == nil || d.Kind != FuncChanged {
+			t.Errorf("Diff() after ALTER FUNCTION %s = %#v; want %s", alter, d, FuncChanged)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package pj
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+)
+
+// testDriver is a database/sql driver for the tests, that answers each query with the result of
+// the registered function for the sql statement.
+type testDriver struct {
+	sync.Mutex
+	results   map[string]func(args []driver.Value) ([]byte, error)
+	prepared  map[string]int // number of times each statement has been prepared
+	commits   int            // number of committed transactions
+	rollbacks int            // number of rolled back transactions
+}
+
+var testDrv = &testDriver{results: map[string]func(args []driver.Value) ([]byte, error){}, prepared: map[string]int{}}
+
+func init() {
+	sql.Register("pjtest", testDrv)
+}
+
+// testDB returns a *sql.DB that answers the given sql statements with the results of the given functions
+func testDB(results map[string]func(args []driver.Value) ([]byte, error)) *sql.DB {
+	testDrv.Lock()
+	for q, fn := range results {
+		testDrv.results[q] = fn
+	}
+	testDrv.Unlock()
+	db, _ := sql.Open("pjtest", "")
+	return db
+}
+
+// testResult returns a function for testDB that always returns the given json
+func testResult(json string) func(args []driver.Value) ([]byte, error) {
+	return func(args []driver.Value) ([]byte, error) {
+		return []byte(json), nil
+	}
+}
+
+func (d *testDriver) Open(name string) (driver.Conn, error) { return testConn{}, nil }
+
+type testConn struct{}
+
+func (c testConn) Prepare(query string) (driver.Stmt, error) {
+	testDrv.Lock()
+	fn, has := testDrv.results[query]
+	testDrv.prepared[query]++
+	testDrv.Unlock()
+	if !has {
+		return nil, errors.New("unexpected query " + query)
+	}
+	return testStmt{fn}, nil
+}
+
+func (c testConn) Close() error              { return nil }
+func (c testConn) Begin() (driver.Tx, error) { return testTx{}, nil }
+
+type testTx struct{}
+
+func (t testTx) Commit() error {
+	testDrv.Lock()
+	testDrv.commits++
+	testDrv.Unlock()
+	return nil
+}
+
+func (t testTx) Rollback() error {
+	testDrv.Lock()
+	testDrv.rollbacks++
+	testDrv.Unlock()
+	return nil
+}
+
+type testStmt struct {
+	fn func(args []driver.Value) ([]byte, error)
+}
+
+func (s testStmt) Close() error  { return nil }
+func (s testStmt) NumInput() int { return -1 }
+func (s testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.fn(args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	b, err := s.fn(args)
+	if err != nil {
+		return nil, err
+	}
+	return &testRows{b: b}, nil
+}
+
+type testRows struct {
+	b    []byte
+	done bool
+}
+
+func (r *testRows) Columns() []string { return []string{"result"} }
+func (r *testRows) Close() error      { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	if r.b == nil {
+		dest[0] = nil
+	} else {
+		dest[0] = r.b
+	}
+	return nil
+}
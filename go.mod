@@ -1,9 +1,12 @@
 module github.com/go-on/pj
 
+go 1.16
+
 require (
 	github.com/jackc/pgx v3.2.0+incompatible
 	github.com/metakeule/config v1.11.5
 	github.com/pkg/errors v0.8.0 // indirect
 	golang.org/x/sys v0.0.0-20180815093151-14742f9018cd // indirect
 	gopkg.in/fsnotify.v1 v1.4.7
+	gopkg.in/metakeule/fmtdate.v1 v1.1.1 // indirect
 )
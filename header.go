@@ -0,0 +1,226 @@
+package pj
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FuncHeader is the metadata of a query function inside a header comment at the beginning of its file, e.g.
+//
+//	/* pj: {"max_body": 65536, "volatility": "STABLE", "security_definer": true, "role": "editor"} */
+//	response.results = plv8.execute('SELECT * FROM persons');
+//
+// The Endpoint settings of the header override the ones of the MountConfig for the endpoint.
+// The other settings are attributes of the generated postgres function.
+// Unknown keys are rejected. The header stays part of the function source.
+type FuncHeader struct {
+	Endpoint
+
+	// MaxBody is a shorter alias of the MaxBodySize of the Endpoint
+	MaxBody int64 `json:"max_body"`
+
+	// SecurityDefiner lets the function execute with the privileges of its owner, see Role.
+	// The search_path of a SECURITY DEFINER function is always fixed, see SearchPath.
+	SecurityDefiner bool `json:"security_definer"`
+
+	// SearchPath is the fixed search_path of the function, a comma separated list of schemas.
+	// It defaults to DefaultSearchPath for SECURITY DEFINER functions and is not fixed otherwise.
+	SearchPath string `json:"search_path"`
+
+	// Parallel is the parallel safety of the function: SAFE, RESTRICTED or UNSAFE (the default of postgres)
+	Parallel string `json:"parallel"`
+
+	// Cost is the estimated execution cost of the function, if > 0
+	Cost float64 `json:"cost"`
+
+	// Role is the role that owns the function, if not empty
+	Role string `json:"role"`
+}
+
+// DefaultSearchPath is the search_path of SECURITY DEFINER functions without a SearchPath.
+// pg_temp is searched last, so that temporary objects of the caller can't shadow the ones of the function.
+const DefaultSearchPath = "public, pg_temp"
+
+// headerComment matches the header comment of a query function file
+var headerComment = regexp.MustCompile(`^\s*/\*\s*pj:((?s).*?)\*/`)
+
+// validRole matches the names of roles that may own the functions and of the schemas of a search_path
+var validRole = regexp.MustCompile(`^[a-z_][a-z_0-9$]*$`)
+
+// parseHeader parses the FuncHeader of the content of a query function file.
+// It returns nil, if the file has no header.
+func parseHeader(fbody []byte) (*FuncHeader, error) {
+	m := headerComment.FindSubmatch(fbody)
+	if m == nil {
+		return nil, nil
+	}
+
+	var h FuncHeader
+	dec := json.NewDecoder(bytes.NewReader(m[1]))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&h)
+	if err != nil {
+		return nil, errors.New("invalid header: " + err.Error())
+	}
+
+	err = validateEndpoint(&h.Endpoint)
+	if err != nil {
+		return nil, errors.New("invalid header: " + err.Error())
+	}
+
+	if h.MaxBody != 0 {
+		if h.MaxBodySize != 0 && h.MaxBodySize != h.MaxBody {
+			return nil, errors.New("invalid header: max_body and max_body_size differ")
+		}
+		h.MaxBodySize, h.MaxBody = h.MaxBody, 0
+	}
+
+	if h.Cost < 0 {
+		return nil, fmt.Errorf("invalid header: cost %v must not be negative", h.Cost)
+	}
+
+	if h.Role != "" && !validRole.MatchString(h.Role) {
+		return nil, errors.New("invalid header: invalid role " + h.Role)
+	}
+
+	if h.SearchPath != "" {
+		for _, schema := range strings.Split(h.SearchPath, ",") {
+			if !validRole.MatchString(strings.TrimSpace(schema)) {
+				return nil, errors.New("invalid header: invalid schema " + schema + " in search_path")
+			}
+		}
+	}
+
+	switch strings.ToUpper(h.Parallel) {
+	case "", "SAFE", "RESTRICTED", "UNSAFE":
+	default:
+		return nil, errors.New("invalid header: parallel " + h.Parallel + " is not allowed")
+	}
+	return &h, nil
+}
+
+// defaultVolatility returns the volatility of the postgres function for the method meth,
+// if none is set: Stable for GET, since it must not write, and Volatile for the other methods
+func defaultVolatility(meth string) string {
+	if strings.ToUpper(meth) == "GET" {
+		return Stable
+	}
+	return Volatile
+}
+
+// attributes returns the attributes of the postgres function for the method meth, that follow its language
+func (h *FuncHeader) attributes(meth string) string {
+	if h == nil {
+		h = &FuncHeader{}
+	}
+
+	attrs := defaultVolatility(meth)
+	if h.Volatility != "" {
+		attrs = strings.ToUpper(h.Volatility)
+	}
+	attrs += " STRICT"
+	if h.SecurityDefiner {
+		attrs += " SECURITY DEFINER"
+	}
+	if h.Parallel != "" {
+		attrs += " PARALLEL " + strings.ToUpper(h.Parallel)
+	}
+	if h.Cost > 0 {
+		attrs += fmt.Sprintf(" COST %v", h.Cost)
+	}
+
+	searchPath := h.SearchPath
+	if searchPath == "" && h.SecurityDefiner {
+		searchPath = DefaultSearchPath
+	}
+	if searchPath != "" {
+		attrs += " SET search_path = " + searchPath
+	}
+	return attrs
+}
+
+// withMountConfig returns the FuncHeader h of the query function for the method meth of the mount path mntp
+// with the volatility of the MountConfig, if h has none
+func (q *QueryCollection) withMountConfig(mntp, meth string, h *FuncHeader) (*FuncHeader, error) {
+	if h != nil && h.Volatility != "" {
+		return h, nil
+	}
+
+	c, err := readMountConfig(q.FS, mntp)
+	if err != nil || c == nil {
+		return h, err
+	}
+
+	e, has := c.Endpoints[strings.ToUpper(meth)]
+	if !has || e == nil || e.Volatility == "" {
+		return h, nil
+	}
+
+	var wh FuncHeader
+	if h != nil {
+		wh = *h
+	}
+	wh.Volatility = e.Volatility
+	return &wh, nil
+}
+
+// merge returns e with the settings that are set in o
+func (e *Endpoint) merge(o *Endpoint) *Endpoint {
+	var m Endpoint
+	if e != nil {
+		m = *e
+	}
+	if o.MaxBodySize > 0 {
+		m.MaxBodySize = o.MaxBodySize
+	}
+	if o.MaxInlineFileSize > 0 {
+		m.MaxInlineFileSize = o.MaxInlineFileSize
+	}
+	if o.ParamPrecedence != nil {
+		m.ParamPrecedence = o.ParamPrecedence
+	}
+	if o.Pagination != nil {
+		m.Pagination = o.Pagination
+	}
+	if o.Limits != nil {
+		m.Limits = o.Limits
+	}
+	if o.Signature != nil {
+		m.Signature = o.Signature
+	}
+	if o.Volatility != "" {
+		m.Volatility = o.Volatility
+	}
+	return &m
+}
+
+// header returns the FuncHeader of the query function file for the method meth of the mount path mntp,
+// or nil, if it has none
+func (q *QueryCollection) header(mntp, meth string) (*FuncHeader, error) {
+	if q.FS == nil {
+		return nil, nil
+	}
+
+	fname, has := q.Queries[mntp][strings.ToUpper(meth)]
+	if !has {
+		return nil, nil
+	}
+
+	file := path.Join(mntp, strings.ToLower(meth), fname+".sql")
+	c, err := fs.ReadFile(q.FS, file)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := parseHeader(c)
+	if err != nil {
+		return nil, &DeployError{File: file, Err: err}
+	}
+	return h, nil
+}
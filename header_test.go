@@ -0,0 +1,102 @@
+package pj
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFuncHeader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"persons/get/all_persons.sql": {Data: []byte(`/* pj: {"max_body_size": 65536, "volatility": "stable", "cost": 50,
+	"signature": {"returns": "json"}} */
+response.results = [];`)},
+		"persons/post/add_person.sql": {Data: []byte(`/* pj: {"max_body": 65536, "security_definer": true, "role": "editor"} */
+response.results = [params];`)},
+		"persons/pj.json":           {Data: []byte(`{"endpoints": {"GET": {"max_body_size": 1024, "max_inline_file_size": 512}}}`)},
+		"things/get/all_things.sql": {Data: []byte(`response.results = [];`)},
+		"things/put/update_thing.sql": {Data: []byte(`/* pj: {"parallel": "safe", "search_path": "things, pg_temp"} */
+response.results = [];`)},
+		"things/pj.json": {Data: []byte(`{"endpoints": {"PUT": {"volatility": "IMMUTABLE"}}}`)},
+	}
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	stmts, err := q.RegisterQueryFuncs(nil, true)
+	if err != nil {
+		t.Fatalf("RegisterQueryFuncs(nil, true) returned error: %s", err)
+	}
+
+	for _, stmt := range stmts {
+		switch {
+		case strings.Contains(stmt, "pj__all_persons__get(params json) RETURNS json AS"):
+			if !strings.Contains(stmt, "LANGUAGE plv8 STABLE STRICT COST 50;") {
+				t.Errorf("missing attributes of the header: %s", stmt)
+			}
+		case strings.Contains(stmt, "pj__add_person__post(params json) RETURNS text AS"):
+			if !strings.Contains(stmt, "LANGUAGE plv8 VOLATILE STRICT SECURITY DEFINER SET search_path = public, pg_temp;") {
+				t.Errorf("missing attributes of the header: %s", stmt)
+			}
+			if !strings.Contains(stmt, "ALTER FUNCTION pj__add_person__post(params json) OWNER TO editor;") {
+				t.Errorf("missing owner of the header: %s", stmt)
+			}
+		case strings.Contains(stmt, "pj__all_things__get(params json) RETURNS text AS"):
+			if !strings.Contains(stmt, "LANGUAGE plv8 STABLE STRICT;") {
+				t.Errorf("GET function must default to STABLE: %s", stmt)
+			}
+		case strings.Contains(stmt, "pj__update_thing__put(params json) RETURNS text AS"):
+			if !strings.Contains(stmt, "LANGUAGE plv8 IMMUTABLE STRICT PARALLEL SAFE SET search_path = things, pg_temp;") {
+				t.Errorf("missing attributes of the header and the mount config: %s", stmt)
+			}
+		default:
+			t.Errorf("unexpected statement %#v", stmt)
+		}
+	}
+
+	mux := testMux{}
+	err = q.RegisterHTTPHandlers(mux, nil, 0)
+	if err != nil {
+		t.Fatalf("RegisterHTTPHandlers() returned error: %s", err)
+	}
+
+	e := q.Handlers["persons"].endpoint("GET")
+	if got, want := e.MaxBodySize, int64(65536); got != want {
+		t.Errorf("MaxBodySize = %d; want %d", got, want)
+	}
+	if got, want := e.MaxInlineFileSize, int64(512); got != want {
+		t.Errorf("MaxInlineFileSize = %d; want %d", got, want)
+	}
+	if got, want := q.Handlers["persons"].endpoint("POST").MaxBodySize, int64(65536); got != want {
+		t.Errorf("MaxBodySize of max_body = %d; want %d", got, want)
+	}
+	if !q.Handlers["persons"].readOnly("GET") {
+		t.Errorf("GET with stable volatility must be read only")
+	}
+
+	invalid := []string{
+		`/* pj: {"max_body": 65536, "max_body_size": 1024} */`,
+		`/* pj: {"max_bodies": 65536} */`,
+		`/* pj: {"volatility": "sometimes"} */`,
+		`/* pj: {"cost": -1} */`,
+		`/* pj: {"role": "editor; DROP TABLE persons"} */`,
+		`/* pj: {"signature": {"params": "text"}} */`,
+		`/* pj: {"max_body_size": 10 */`,
+		`/* pj: {"parallel": "always"} */`,
+		`/* pj: {"search_path": "public; RESET ALL"} */`,
+	}
+
+	for _, inv := range invalid {
+		fsys["persons/post/add_person.sql"] = &fstest.MapFile{Data: []byte(inv + "\nresponse.results = [];")}
+		_, err = q.RegisterQueryFuncs(nil, true)
+		if _, ok := err.(*DeployError); !ok {
+			t.Errorf("RegisterQueryFuncs() with header %s returned %v; want DeployError", inv, err)
+		}
+	}
+
+	if h, err := parseHeader([]byte("var x = 1; /* pj: {\"cost\": 1} */")); h != nil || err != nil {
+		t.Errorf("parseHeader() of a comment after the beginning = %v, %v; want nil, nil", h, err)
+	}
+}
@@ -0,0 +1,284 @@
+package pj
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultDenyHeaders are the response headers that query functions may not set via "http_headers",
+// if PJ.DenyHeaders is nil. They protect the security headers set by middleware.
+var DefaultDenyHeaders = []string{
+	"Strict-Transport-Security",
+	"Content-Security-Policy",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"Referrer-Policy",
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+}
+
+// hopByHopHeaders are the headers that are meaningful only for a single transport-level connection
+// and the Content-Length that is controlled by the server. They are forbidden for hardened PJs.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// isTokenChar reports whether c is allowed within a token as defined by RFC 7230, section 3.2.6
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// validHeaderName reports whether name is a valid header field name, i.e. a token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports whether the header field value v contains no control characters except tabs
+func validHeaderValue(v string) bool {
+	for _, c := range v {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHeader returns an error, if the query function is not allowed to set the header with the given name
+func (p *PJ) checkHeader(name string) error {
+	if !validHeaderName(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+
+	if p.Hardened && containsHeader(hopByHopHeaders, name) {
+		return errors.New("header " + name + " is not allowed in hardened mode")
+	}
+
+	if len(p.AllowHeaders) > 0 && !containsHeader(p.AllowHeaders, name) {
+		return errors.New("header " + name + " is not allowed")
+	}
+
+	deny := p.DenyHeaders
+	if deny == nil {
+		deny = DefaultDenyHeaders
+	}
+	if containsHeader(deny, name) {
+		return errors.New("header " + name + " is denied")
+	}
+	return nil
+}
+
+func containsHeader(list []string, name string) bool {
+	for _, h := range list {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHeaders converts the "http_headers" property of a result to http.Header. The values may be
+// strings, numbers or booleans or arrays of them for multi-valued headers.
+func (p *PJ) parseHeaders(v interface{}) (headers http.Header, err error) {
+	h, ok := v.(map[string]interface{})
+	if !ok {
+		err = errors.New("http_headers is not a map")
+		return
+	}
+
+	headers = http.Header{}
+
+	for k, v := range h {
+		err = p.checkHeader(k)
+		if err != nil {
+			return nil, err
+		}
+
+		vals, isArr := v.([]interface{})
+		if !isArr {
+			vals = []interface{}{v}
+		}
+
+		for _, val := range vals {
+			switch val.(type) {
+			case string, float64, bool:
+				s := fmt.Sprintf("%v", val)
+				if !validHeaderValue(s) {
+					return nil, fmt.Errorf("invalid value %q of header %s", s, k)
+				}
+				headers.Add(k, s)
+			default:
+				return nil, fmt.Errorf("value of header %s is not a string, number, boolean or array of them", k)
+			}
+		}
+	}
+
+	return headers, nil
+}
+
+// Cookie is a cookie as it is set by a query function via the "http_cookies" property, which is an array of Cookie objects
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path"`
+	Domain   string `json:"domain"`
+	Expires  string `json:"expires"` // RFC 3339, e.g. 2006-01-02T15:04:05Z
+	MaxAge   int    `json:"max_age"`
+	HttpOnly bool   `json:"http_only"`
+	Secure   bool   `json:"secure"`
+	SameSite string `json:"same_site"` // "lax", "strict" or "none"
+}
+
+// httpCookie converts the Cookie to a *http.Cookie
+func (c Cookie) httpCookie() (*http.Cookie, error) {
+	if c.Name == "" {
+		return nil, errors.New("cookie without name")
+	}
+
+	hc := &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		MaxAge:   c.MaxAge,
+		HttpOnly: c.HttpOnly,
+		Secure:   c.Secure,
+	}
+
+	if c.Expires != "" {
+		t, err := time.Parse(time.RFC3339, c.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires of cookie %s: %s", c.Name, err.Error())
+		}
+		hc.Expires = t
+	}
+
+	switch strings.ToLower(c.SameSite) {
+	case "":
+	case "lax":
+		hc.SameSite = http.SameSiteLaxMode
+	case "strict":
+		hc.SameSite = http.SameSiteStrictMode
+	case "none":
+		hc.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid same_site of cookie %s: %s", c.Name, c.SameSite)
+	}
+
+	if err := hc.Valid(); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// parseCookies converts the "http_cookies" property of a result to cookies
+func parseCookies(v interface{}) (cookies []*http.Cookie, err error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("http_cookies is not an array")
+	}
+
+	for _, c := range arr {
+		m, ok := c.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("http_cookies contains a cookie that is not an object")
+		}
+
+		var cookie Cookie
+		err = remarshal(m, &cookie)
+		if err != nil {
+			return nil, err
+		}
+
+		hc, err := cookie.httpCookie()
+		if err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, hc)
+	}
+	return
+}
+
+// parseRedirect returns the location of the "http_redirect" property of a result and the status code
+// for the redirect: the given code, if it is a redirect code, otherwise 302 Found for GET requests
+// and 303 See Other for the other methods.
+func parseRedirect(v interface{}, meth string, code int) (location string, status int, err error) {
+	location, ok := v.(string)
+	if !ok || location == "" {
+		return "", 0, errors.New("http_redirect is not a string")
+	}
+
+	switch {
+	case code >= 300 && code < 400:
+		status = code
+	case meth == "GET":
+		status = http.StatusFound
+	default:
+		status = http.StatusSeeOther
+	}
+	return
+}
+
+// responseProps are the properties of a result that are applied to the response and not sent in its body
+var responseProps = []string{"http_headers", "http_cookies", "http_redirect"}
+
+// stripResponseProps returns the result b without the responseProps, so that e.g. the values of
+// HttpOnly cookies do not leak into the body. b is returned unchanged, if it has none of them.
+func stripResponseProps(b []byte) ([]byte, error) {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, k := range responseProps {
+		if _, has := m[k]; has {
+			delete(m, k)
+			found = true
+		}
+	}
+	if !found {
+		return b, nil
+	}
+	return json.Marshal(m)
+}
+
+// remarshal converts the decoded json value v into the target, rejecting unknown properties
+func remarshal(v interface{}, target interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(target)
+}
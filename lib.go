@@ -0,0 +1,311 @@
+package pj
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LibDir is the directory below the root that holds the javascript modules that are shared by the
+// query functions, e.g.
+//
+//	_lib/validate.js
+//	_lib/http/response.js
+//
+// A module sets its exports like a CommonJS module (via module.exports or exports) and is loaded
+// by require('validate') or require('http/response') inside the query functions and other modules.
+// The names of the modules must be string literals.
+//
+// The modules are deployed into the ModulesTable. Each query function that requires modules gets a require
+// function that loads the modules from the table and caches them per session. The versions of the modules
+// are part of the query function, so the query functions are deployed again, if a module they require changes,
+// see UpdateLib.
+const LibDir = "_lib"
+
+// ModulesTable is the table that the modules of the LibDir are deployed into
+const ModulesTable = "pj_modules"
+
+// libModule is a module of the LibDir
+type libModule struct {
+	src      string
+	requires []string // the names of the required modules
+	version  string   // the hash of the source and the versions of the required modules
+}
+
+// requireCall matches the calls of require with the name of a module
+var requireCall = regexp.MustCompile(`\brequire\(\s*['"]([^'"]*)['"]\s*\)`)
+
+// requires returns the sorted names of the modules that are required by the javascript src
+func requires(src []byte) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range requireCall.FindAllSubmatch(src, -1) {
+		if name := string(m[1]); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// libs reads the modules of the LibDir, keyed by their names
+func (q *QueryCollection) libs() (map[string]*libModule, error) {
+	mods := map[string]*libModule{}
+	if _, err := fs.Stat(q.FS, LibDir); errors.Is(err, fs.ErrNotExist) {
+		return mods, nil
+	}
+
+	err := fs.WalkDir(q.FS, LibDir, func(f string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(f) != ".js" {
+			return nil
+		}
+
+		name, err := moduleName(f)
+		if err != nil {
+			return err
+		}
+
+		c, err := fs.ReadFile(q.FS, f)
+		if err != nil {
+			return err
+		}
+		mods[name] = &libModule{src: string(c), requires: requires(c)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range mods {
+		if _, err = moduleVersion(mods, name, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return mods, nil
+}
+
+// moduleName returns the name of the module of the file f inside the LibDir
+func moduleName(f string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(f, LibDir+"/"), ".js")
+	if !strings.HasPrefix(f, LibDir+"/") || path.Ext(f) != ".js" {
+		return "", errors.New("invalid module file " + f + ": must be " + LibDir + "/[module].js")
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if !validName.MatchString(seg) {
+			return "", errors.New("invalid module file " + f + ": invalid segment " + seg)
+		}
+	}
+	return name, nil
+}
+
+// moduleVersion returns the version of the module name and sets it, if it is not set yet.
+// visiting holds the modules whose versions are being calculated, in order to detect cyclic requires.
+func moduleVersion(mods map[string]*libModule, name string, visiting map[string]bool) (string, error) {
+	m, has := mods[name]
+	if !has {
+		return "", errors.New("module " + name + " does not exist")
+	}
+	if m.version != "" {
+		return m.version, nil
+	}
+	if visiting[name] {
+		return "", errors.New("module " + name + " requires itself")
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	h := sha256.New()
+	io.WriteString(h, m.src)
+	for _, r := range m.requires {
+		v, err := moduleVersion(mods, r, visiting)
+		if err != nil {
+			return "", errors.New("module " + name + ": " + err.Error())
+		}
+		io.WriteString(h, "\x00"+r+"@"+v)
+	}
+	m.version = hex.EncodeToString(h.Sum(nil))[:16]
+	return m.version, nil
+}
+
+// deps returns the versions of the modules that are required by the javascript src, directly
+// or via other modules, keyed by their names
+func deps(mods map[string]*libModule, src []byte) (map[string]string, error) {
+	versions := map[string]string{}
+	var add func(names []string) error
+	add = func(names []string) error {
+		for _, name := range names {
+			if _, has := versions[name]; has {
+				continue
+			}
+			m, has := mods[name]
+			if !has {
+				return errors.New("required module " + name + " does not exist")
+			}
+			versions[name] = m.version
+			if err := add(m.requires); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return versions, add(requires(src))
+}
+
+// dependsOn reports whether the javascript src requires the module name, directly or via other modules
+func dependsOn(mods map[string]*libModule, src []byte, name string) bool {
+	seen := map[string]bool{}
+	var visit func(names []string) bool
+	visit = func(names []string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+			if m, has := mods[n]; has && !seen[n] {
+				seen[n] = true
+				if visit(m.requires) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return visit(requires(src))
+}
+
+// requireFunc returns the declaration of the require function for the query function, that
+// requires the modules with the given versions. It is placed after the return statement of the
+// query function, so that the lines of the query function file are not shifted. It returns
+// an empty string, if no modules are required.
+func requireFunc(versions map[string]string) string {
+	if len(versions) == 0 {
+		return ""
+	}
+	v, _ := json.Marshal(versions)
+	return fmt.Sprintf(`  function require(name) {
+	var versions = %s;
+	if (!versions.hasOwnProperty(name))
+		throw new Error('module ' + name + ' is not required by the query function');
+	var key = name + '@' + versions[name];
+	var cache = plv8.pj_modules || (plv8.pj_modules = {});
+	if (!cache.hasOwnProperty(key)) {
+		var rows = plv8.execute('SELECT source FROM %s WHERE name = $1 AND version = $2', [name, versions[name]]);
+		if (rows.length == 0)
+			throw new Error('module ' + key + ' is not deployed');
+		var module = {exports: {}};
+		cache[key] = module;
+		(new Function('module', 'exports', 'require', rows[0].source))(module, module.exports, require);
+	}
+	return cache[key].exports;
+  }
+`, v, ModulesTable)
+}
+
+// libSql returns the sql that deploys the modules into the ModulesTable. It returns an empty
+// string, if there are no modules.
+func libSql(mods map[string]*libModule) string {
+	if len(mods) == 0 {
+		return ""
+	}
+
+	var names []string
+	for name := range mods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var values []string
+	for _, name := range names {
+		values = append(values, fmt.Sprintf("(%s, %s, %s)", quoteLiteral(name), quoteLiteral(mods[name].version), quoteLiteral(mods[name].src)))
+	}
+
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	name    text NOT NULL,
+	version text NOT NULL,
+	source  text NOT NULL,
+	PRIMARY KEY (name, version)
+);
+INSERT INTO %s (name, version, source) VALUES %s ON CONFLICT DO NOTHING;`, ModulesTable, ModulesTable, strings.Join(values, ",\n\t"))
+}
+
+// pruneLibSql returns the sql that removes the modules and versions from the ModulesTable
+// that are not part of mods. It returns an empty string, if there are no modules.
+func pruneLibSql(mods map[string]*libModule) string {
+	if len(mods) == 0 {
+		return ""
+	}
+
+	var names []string
+	for name := range mods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var values []string
+	for _, name := range names {
+		values = append(values, fmt.Sprintf("(%s, %s)", quoteLiteral(name), quoteLiteral(mods[name].version)))
+	}
+	return fmt.Sprintf(`DELETE FROM %s WHERE (name, version) NOT IN (VALUES %s);`, ModulesTable, strings.Join(values, ", "))
+}
+
+// UpdateLib deploys the modules of the LibDir after the module file relpath has been added, changed
+// or removed, and deploys the query functions again that require the module, directly or via other modules.
+func (q *QueryCollection) UpdateLib(db DB, relpath string) error {
+	if q.FS == nil {
+		return errNoFiles
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	name, err := moduleName(filepath.ToSlash(relpath))
+	if err != nil {
+		return err
+	}
+
+	mods, err := q.libs()
+	if err != nil {
+		return err
+	}
+
+	if stmt := libSql(mods); stmt != "" {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	q.EachFile(func(file, funcname, meth string) {
+		if err != nil {
+			return
+		}
+		var c []byte
+		c, err = fs.ReadFile(q.FS, file)
+		if err != nil || !dependsOn(mods, c, name) {
+			return
+		}
+		_, err = q.deployFile(db, file, meth, funcname, mods, false)
+		if err == nil {
+			q.invalidate(path.Dir(path.Dir(file)), FuncName(meth, funcname))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if stmt := pruneLibSql(mods); stmt != "" {
+		_, err = db.Exec(stmt)
+	}
+	return err
+}
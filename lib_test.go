@@ -0,0 +1,129 @@
+package pj
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// execDB is a DB for the tests that records the executed statements
+type execDB struct {
+	stmts []string
+}
+
+func (e *execDB) QueryRow(sql string, args ...interface{}) *sql.Row { return nil }
+
+func (e *execDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.stmts = append(e.stmts, query)
+	return nil, nil
+}
+
+func TestLib(t *testing.T) {
+	fsys := fstest.MapFS{
+		"_lib/validate.js":      {Data: []byte(`exports.required = function(p, k) { if (!(k in p)) throw new Error(k); };`)},
+		"_lib/http/response.js": {Data: []byte(`var v = require('validate'); module.exports = function(r) { return r; };`)},
+		"_lib/unused.js":        {Data: []byte(`exports.x = 1;`)},
+		"persons/post/add_person.sql": {Data: []byte(`require("http/response")(response);
+response.results = [params];`)},
+		"persons/get/all_persons.sql": {Data: []byte(`response.results = [];`)},
+	}
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	if got, want := len(q.Queries["persons"]), 2; got != want {
+		t.Fatalf("number of query functions = %d; want %d", got, want)
+	}
+
+	mods, err := q.libs()
+	if err != nil {
+		t.Fatalf("libs() returned error: %s", err)
+	}
+
+	stmts, err := q.RegisterQueryFuncs(nil, true)
+	if err != nil {
+		t.Fatalf("RegisterQueryFuncs(nil, true) returned error: %s", err)
+	}
+
+	if got, want := len(stmts), 4; got != want {
+		t.Fatalf("number of statements = %d; want %d", got, want)
+	}
+
+	if !strings.Contains(stmts[0], "INSERT INTO pj_modules") || !strings.Contains(stmts[0], "'http/response', '"+mods["http/response"].version+"'") {
+		t.Errorf("first statement must deploy the modules: %s", stmts[0])
+	}
+
+	if !strings.HasPrefix(stmts[3], "DELETE FROM pj_modules") {
+		t.Errorf("last statement must prune the modules: %s", stmts[3])
+	}
+
+	for _, stmt := range stmts[1:3] {
+		switch {
+		case strings.Contains(stmt, "pj__add_person__post"):
+			if !strings.Contains(stmt, `"http/response":"`+mods["http/response"].version+`"`) ||
+				!strings.Contains(stmt, `"validate":"`+mods["validate"].version+`"`) ||
+				strings.Contains(stmt, `"unused"`) {
+				t.Errorf("function must require http/response and validate: %s", stmt)
+			}
+		case strings.Contains(stmt, "pj__all_persons__get"):
+			if strings.Contains(stmt, "function require") {
+				t.Errorf("function without modules must not declare require: %s", stmt)
+			}
+		default:
+			t.Errorf("unexpected statement %#v", stmt)
+		}
+	}
+
+	// the version of a module changes with the modules it requires
+	old := mods["http/response"].version
+	fsys["_lib/validate.js"] = &fstest.MapFile{Data: []byte(`exports.required = function() {};`)}
+
+	db := &execDB{}
+	err = q.UpdateLib(db, "_lib/validate.js")
+	if err != nil {
+		t.Fatalf("UpdateLib() returned error: %s", err)
+	}
+
+	if got, want := len(db.stmts), 4; got != want {
+		t.Fatalf("number of executed statements = %d; want %d: %v", got, want, db.stmts)
+	}
+
+	mods, _ = q.libs()
+	if mods["http/response"].version == old {
+		t.Errorf("version of http/response must change with validate")
+	}
+
+	if !strings.Contains(db.stmts[2], "pj__add_person__post") || !strings.Contains(db.stmts[2], mods["http/response"].version) {
+		t.Errorf("dependent function must be deployed again with the new version: %s", db.stmts[2])
+	}
+
+	db = &execDB{}
+	err = q.UpdateLib(db, "_lib/unused.js")
+	if err != nil {
+		t.Fatalf("UpdateLib() returned error: %s", err)
+	}
+	if got, want := len(db.stmts), 2; got != want {
+		t.Errorf("number of executed statements without dependents = %d; want %d: %v", got, want, db.stmts)
+	}
+
+	invalid := map[string]string{
+		"_lib/validate.js":        `require('http/response');`,
+		"_lib/Invalid.js":         `exports.x = 1;`,
+		"persons/get/missing.sql": `require('missing');`,
+	}
+
+	for file, src := range invalid {
+		fs := fstest.MapFS{"_lib/http/response.js": fsys["_lib/http/response.js"], "_lib/validate.js": fsys["_lib/validate.js"]}
+		fs[file] = &fstest.MapFile{Data: []byte(src)}
+		qc, err := NewQueryCollectionFS(fs, nil)
+		if err != nil {
+			t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+		}
+		if _, err = qc.RegisterQueryFuncs(nil, true); err == nil {
+			t.Errorf("RegisterQueryFuncs() with %s must return error", file)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package pj
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits is the admission control of a query function: a token bucket rate limit per client
+// and a cap on the number of concurrent calls of the query function.
+// Requests that exceed the limits are answered with 429 Too Many Requests and a Retry-After header.
+type Limits struct {
+	// Rate is the number of requests per second that a client may send, no rate limit if <= 0.
+	// Clients are identified by PJ.ClientID.
+	Rate float64 `json:"rate"`
+
+	// Burst is the number of requests that a client may send at once, defaults to Rate (at least 1)
+	Burst int `json:"burst"`
+
+	// MaxInFlight is the max number of concurrent calls of the query function, unlimited if <= 0
+	MaxInFlight int `json:"max_in_flight"`
+
+	// MaxQueue is the max number of requests that wait for a call of the query function, if MaxInFlight is reached.
+	// If 0, such requests are rejected immediately.
+	MaxQueue int `json:"max_queue"`
+}
+
+func (l *Limits) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// maxBuckets is the max number of token buckets of a limiter. Beyond it the bucket of the client
+// that has been seen least recently is removed.
+const maxBuckets = 1 << 14
+
+// bucket is the token bucket of a client
+type bucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+// limiter enforces the Limits of a query function
+type limiter struct {
+	limits Limits
+	slots  chan struct{} // nil, if the number of calls is unlimited
+
+	mu       sync.Mutex
+	buckets  map[string]*list.Element // the elements of lru, keyed by client
+	lru      *list.List               // the buckets, the one of the most recently seen client first
+	inFlight int
+	queued   int
+}
+
+func newLimiter(l Limits) *limiter {
+	li := &limiter{limits: l, buckets: map[string]*list.Element{}, lru: list.New()}
+	if l.MaxInFlight > 0 {
+		li.slots = make(chan struct{}, l.MaxInFlight)
+	}
+	return li
+}
+
+// allow takes a token from the bucket of the client. If there is none, it returns the duration
+// after which the next token is available.
+func (li *limiter) allow(client string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if li.limits.Rate <= 0 {
+		return true, 0
+	}
+
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	burst := li.limits.burst()
+
+	el, has := li.buckets[client]
+	if has {
+		li.lru.MoveToFront(el)
+	} else {
+		el = li.lru.PushFront(&bucket{client: client, tokens: burst, last: now})
+		li.buckets[client] = el
+		if li.lru.Len() > maxBuckets {
+			delete(li.buckets, li.lru.Remove(li.lru.Back()).(*bucket).client)
+		}
+	}
+	b := el.Value.(*bucket)
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*li.limits.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / li.limits.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+var errQueueFull = errors.New("too many concurrent requests")
+
+// acquire waits for a free slot to call the query function. It returns errQueueFull, if the queue is full,
+// or the error of the context, if it is done before a slot is free.
+// observe is called with the number of calls in flight and of queued requests whenever they change.
+func (li *limiter) acquire(ctx context.Context, observe func(inFlight, queued int)) (release func(), err error) {
+	if li.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case li.slots <- struct{}{}:
+		li.change(1, 0, observe)
+		return li.releaser(observe), nil
+	default:
+	}
+
+	li.mu.Lock()
+	if li.queued >= li.limits.MaxQueue {
+		li.mu.Unlock()
+		return nil, errQueueFull
+	}
+	li.queued++
+	in, q := li.inFlight, li.queued
+	li.mu.Unlock()
+	if observe != nil {
+		observe(in, q)
+	}
+
+	select {
+	case li.slots <- struct{}{}:
+		li.change(1, -1, observe)
+		return li.releaser(observe), nil
+	case <-ctx.Done():
+		li.change(0, -1, observe)
+		return nil, ctx.Err()
+	}
+}
+
+func (li *limiter) releaser(observe func(inFlight, queued int)) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-li.slots
+			li.change(-1, 0, observe)
+		})
+	}
+}
+
+func (li *limiter) change(inFlight, queued int, observe func(inFlight, queued int)) {
+	li.mu.Lock()
+	li.inFlight += inFlight
+	li.queued += queued
+	in, q := li.inFlight, li.queued
+	li.mu.Unlock()
+
+	if observe != nil {
+		observe(in, q)
+	}
+}
+
+// limits returns the Limits for the method meth, or nil, if there are none
+func (p *PJ) limits(meth string) *Limits {
+	if l := p.endpoint(meth).Limits; l != nil {
+		return l
+	}
+	return p.Limits
+}
+
+// limiter returns the limiter for the method meth, or nil, if the method has no Limits
+func (p *PJ) limiter(meth string) *limiter {
+	l := p.limits(meth)
+	if l == nil {
+		return nil
+	}
+
+	p.limitersMu.Lock()
+	defer p.limitersMu.Unlock()
+
+	li, has := p.limiters[meth]
+	if !has || li.limits != *l {
+		if p.limiters == nil {
+			p.limiters = map[string]*limiter{}
+		}
+		li = newLimiter(*l)
+		p.limiters[meth] = li
+	}
+	return li
+}
+
+// clientID returns the identity of the client of the request r
+func (p *PJ) clientID(r *http.Request) string {
+	if p.ClientID != nil {
+		return p.ClientID(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit applies the rate limit of the Limits of the method of the request r
+func (p *PJ) rateLimit(w http.ResponseWriter, r *http.Request) error {
+	li := p.limiter(method(r))
+	if li == nil {
+		return nil
+	}
+
+	ok, retryAfter := li.allow(p.clientID(r), time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return newProblem(http.StatusTooManyRequests, ErrTooManyRequests, errors.New("rate limit exceeded"))
+	}
+	return nil
+}
+
+// admit waits for a free slot to call the query function of the method of the request r, according to
+// its Limits. It returns a function that must be called after the query function has been called.
+func (p *PJ) admit(w http.ResponseWriter, r *http.Request) (release func(), err error) {
+	li := p.limiter(method(r))
+	if li == nil {
+		return func() {}, nil
+	}
+
+	var observe func(inFlight, queued int)
+	if p.QueueObserver != nil {
+		observe = func(inFlight, queued int) { p.QueueObserver(r, inFlight, queued) }
+	}
+
+	release, err = li.acquire(r.Context(), observe)
+	if err == errQueueFull {
+		w.Header().Set("Retry-After", "1")
+		return nil, newProblem(http.StatusTooManyRequests, ErrTooManyRequests, err)
+	}
+	if err != nil {
+		return nil, newProblem(http.StatusServiceUnavailable, ErrTooManyRequests, err)
+	}
+	return release, nil
+}
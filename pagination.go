@@ -0,0 +1,169 @@
+package pj
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Pagination is the pagination mode of an endpoint.
+//
+// The page is requested via the url query parameters "limit" and "offset" or, if Cursor is set,
+// "limit" and "cursor". It is validated and passed to the query function as the property "page" of the params,
+// e.g. {"limit": 20, "offset": 40} or {"limit": 20, "cursor": "abc"}.
+//
+// The query function may return the properties "total" (the total number of items) and, in cursor mode,
+// "next_cursor" (the opaque cursor of the next page, null or empty for the last page).
+// From them the RFC 8288 Link header with the relations first, prev, next and last and the X-Total-Count header are set.
+// Without "total", there is a next page in offset mode, if the "results" have the requested limit.
+type Pagination struct {
+	DefaultLimit int  `json:"default_limit"` // limit if none is requested, defaults to 20
+	MaxLimit     int  `json:"max_limit"`     // max limit that can be requested, defaults to 100
+	Cursor       bool `json:"cursor"`        // cursor based instead of offset based pagination
+}
+
+// Page is the page that is passed to the query function as property "page" of the params
+type Page struct {
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+func (pg *Pagination) limits() (def, max int) {
+	def, max = pg.DefaultLimit, pg.MaxLimit
+	if max <= 0 {
+		max = 100
+	}
+	if def <= 0 {
+		def = 20
+	}
+	if def > max {
+		def = max
+	}
+	return
+}
+
+// page parses and validates the requested page from the url query
+func (pg *Pagination) page(query url.Values) (*Page, error) {
+	def, max := pg.limits()
+	page := &Page{Limit: def}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > max {
+			return nil, newProblem(http.StatusBadRequest, ErrInvalidPagination, fmt.Errorf("limit must be an integer between 1 and %d", max))
+		}
+		page.Limit = limit
+	}
+
+	if pg.Cursor {
+		page.Cursor = query.Get("cursor")
+		return page, nil
+	}
+
+	if o := query.Get("offset"); o != "" {
+		offset, err := strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return nil, newProblem(http.StatusBadRequest, ErrInvalidPagination, fmt.Errorf("offset must be an integer >= 0"))
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+// pageLink returns a link to the request url with the given query parameters replaced
+// (or removed, if the value is empty) for the given relation type
+func pageLink(u *url.URL, rel string, params ...string) string {
+	q := u.Query()
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i+1] == "" {
+			q.Del(params[i])
+		} else {
+			q.Set(params[i], params[i+1])
+		}
+	}
+	l := url.URL{Path: u.Path, RawQuery: q.Encode()}
+	return "<" + l.String() + `>; rel="` + rel + `"`
+}
+
+// headers returns the Link and X-Total-Count headers for the requested page and the result of the query function
+func (pg *Pagination) headers(u *url.URL, page *Page, resp map[string]interface{}) (http.Header, error) {
+	var (
+		h      = http.Header{}
+		links  []string
+		limit  = strconv.Itoa(page.Limit)
+		total  = -1
+		hasMax bool
+	)
+
+	if t, has := resp["total"]; has && t != nil {
+		f, ok := t.(float64)
+		if !ok || f < 0 {
+			return nil, fmt.Errorf("total is not a number >= 0")
+		}
+		total = int(f)
+		hasMax = true
+		h.Set("X-Total-Count", strconv.Itoa(total))
+	}
+
+	if pg.Cursor {
+		links = append(links, pageLink(u, "first", "limit", limit, "cursor", ""))
+		if c, has := resp["next_cursor"]; has && c != nil {
+			next, ok := c.(string)
+			if !ok {
+				return nil, fmt.Errorf("next_cursor is not a string")
+			}
+			if next != "" {
+				links = append(links, pageLink(u, "next", "limit", limit, "cursor", next))
+			}
+		}
+		h.Set("Link", strings.Join(links, ", "))
+		return h, nil
+	}
+
+	links = append(links, pageLink(u, "first", "limit", limit, "offset", ""))
+
+	if page.Offset > 0 {
+		prev := page.Offset - page.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(u, "prev", "limit", limit, "offset", strconv.Itoa(prev)))
+	}
+
+	next := page.Offset + page.Limit
+	hasNext := hasMax && next < total
+	if !hasMax {
+		results, _ := resp["results"].([]interface{})
+		hasNext = len(results) >= page.Limit
+	}
+	if hasNext {
+		links = append(links, pageLink(u, "next", "limit", limit, "offset", strconv.Itoa(next)))
+	}
+
+	if hasMax && total > 0 {
+		last := (total - 1) / page.Limit * page.Limit
+		links = append(links, pageLink(u, "last", "limit", limit, "offset", strconv.Itoa(last)))
+	}
+
+	h.Set("Link", strings.Join(links, ", "))
+	return h, nil
+}
+
+// addPage adds the page as property "page" to the json object params.
+// If params is no json object, it is returned unchanged.
+func addPage(params []byte, page *Page) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(params, &obj) != nil {
+		return params, nil
+	}
+	pb, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+	obj["page"] = pb
+	return json.Marshal(obj)
+}
@@ -0,0 +1,251 @@
+package pj
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// File is an uploaded file of a multipart/form-data request as it is passed to the query function
+type File struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Data        string `json:"data_base64"` // the base64 encoded content
+}
+
+// The sources of the params that are merged, see Endpoint.ParamPrecedence
+const (
+	ParamsPath  = "path"  // the params returned by PJ.PathParams
+	ParamsBody  = "body"  // the params from the request body
+	ParamsQuery = "query" // the params from the url query
+)
+
+// DefaultParamPrecedence is the default precedence of the param sources: path params win over
+// body params, which win over query params.
+var DefaultParamPrecedence = []string{ParamsPath, ParamsBody, ParamsQuery}
+
+// params returns the json params for the query function of the request r for the method meth.
+//
+// For GET requests the params are the url query. Otherwise they are read from the request body
+// depending on its content type:
+//
+//	application/json (or no content type)  the body, that must be valid json
+//	application/x-www-form-urlencoded      the form values as json object like the url query
+//	multipart/form-data                    the form values as json object like the url query,
+//	                                       files are passed as arrays of File objects
+//
+// Other content types are rejected with 415 Unsupported Media Type.
+// An empty body is treated as an empty json object.
+//
+// The url query (in the same format as for GET requests) and the params returned by PJ.PathParams
+// are merged into the json object of the body. For properties that are given by more than one source,
+// the ParamPrecedence of the endpoint decides. If the body is no json object, it is passed unmerged.
+func (p *PJ) params(r *http.Request, meth string) ([]byte, error) {
+	var pathParams map[string]string
+	if p.PathParams != nil {
+		pathParams = p.PathParams(r)
+	}
+
+	if meth == "GET" {
+		if len(pathParams) == 0 {
+			return json.Marshal(r.URL.Query())
+		}
+		return p.mergeParams(meth, []byte("{}"), r.URL.Query(), pathParams)
+	}
+
+	b, err := p.bodyParams(r, meth)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	if len(query) == 0 && len(pathParams) == 0 {
+		return b, nil
+	}
+	return p.mergeParams(meth, b, query, pathParams)
+}
+
+// mergeParams merges the url query and the path params into the json object body according to the
+// ParamPrecedence of the endpoint of the method meth
+func (p *PJ) mergeParams(meth string, body []byte, query url.Values, pathParams map[string]string) ([]byte, error) {
+	var bodyParams map[string]json.RawMessage
+	if json.Unmarshal(body, &bodyParams) != nil {
+		// no json object
+		return body, nil
+	}
+
+	precedence := p.endpoint(meth).ParamPrecedence
+	if len(precedence) == 0 {
+		precedence = DefaultParamPrecedence
+	}
+
+	merged := map[string]interface{}{}
+
+	// start with the lowest precedence, so that the higher ones override
+	for i := len(precedence) - 1; i >= 0; i-- {
+		switch precedence[i] {
+		case ParamsPath:
+			for k, v := range pathParams {
+				merged[k] = v
+			}
+		case ParamsBody:
+			for k, v := range bodyParams {
+				merged[k] = v
+			}
+		case ParamsQuery:
+			for k, v := range query {
+				merged[k] = v
+			}
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// bodyParams returns the json params from the request body
+func (p *PJ) bodyParams(r *http.Request, meth string) ([]byte, error) {
+	mediaType, mparams, err := contentType(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := p.readBody(r, meth)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return []byte("{}"), nil
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		vals, err := url.ParseQuery(string(b))
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, ErrInvalidForm, err)
+		}
+		return json.Marshal(vals)
+	case "multipart/form-data":
+		return multipartParams(b, mparams["boundary"], p.endpoint(meth).MaxInlineFileSize)
+	default:
+		// just validate the json should be fast, see https://github.com/golang/go/issues/5683
+		// var x struct{}
+		// err = json.Unmarshal(b, &x)
+		// improved performance, based on https://github.com/golang/go/issues/18086
+		err = isValidJSON(b)
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, ErrInvalidJSON, err)
+		}
+		return b, nil
+	}
+}
+
+// contentType returns the media type of the request body and its parameters.
+// It returns a problem, if the content type is not supported.
+func contentType(r *http.Request) (mediaType string, params map[string]string, err error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return "application/json", nil, nil
+	}
+
+	mediaType, params, err = mime.ParseMediaType(ct)
+	if err != nil {
+		return "", nil, newProblem(http.StatusUnsupportedMediaType, ErrUnsupportedMediaType, err)
+	}
+
+	switch {
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data":
+		return
+	default:
+		return "", nil, newProblem(http.StatusUnsupportedMediaType, ErrUnsupportedMediaType, errors.New("unsupported content type "+mediaType))
+	}
+}
+
+// readBody reads the request body and returns a problem, if it exceeds the max body size of the method
+func (p *PJ) readBody(r *http.Request, meth string) ([]byte, error) {
+	defer r.Body.Close()
+
+	max := p.maxBodySize(meth)
+	if r.ContentLength > max {
+		return nil, newProblem(http.StatusRequestEntityTooLarge, ErrBodyTooLarge, fmt.Errorf("body must not be larger than %d bytes", max))
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, ErrBadRequest, err)
+	}
+
+	if int64(len(b)) > max {
+		return nil, newProblem(http.StatusRequestEntityTooLarge, ErrBodyTooLarge, fmt.Errorf("body must not be larger than %d bytes", max))
+	}
+	return b, nil
+}
+
+// multipartParams converts the multipart/form-data body b into a json object.
+// Files are base64 encoded. If maxFileSize is > 0, files larger than maxFileSize are rejected.
+func multipartParams(b []byte, boundary string, maxFileSize int64) ([]byte, error) {
+	if boundary == "" {
+		return nil, newProblem(http.StatusBadRequest, ErrInvalidForm, errors.New("missing multipart boundary"))
+	}
+
+	var (
+		params = map[string]interface{}{}
+		values = map[string][]string{}
+		files  = map[string][]File{}
+		mr     = multipart.NewReader(bytes.NewReader(b), boundary)
+	)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, ErrInvalidForm, err)
+		}
+
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, ErrInvalidForm, err)
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			values[name] = append(values[name], string(data))
+			continue
+		}
+
+		if maxFileSize > 0 && int64(len(data)) > maxFileSize {
+			return nil, newProblem(http.StatusRequestEntityTooLarge, ErrBodyTooLarge, fmt.Errorf("file %s must not be larger than %d bytes", part.FileName(), maxFileSize))
+		}
+
+		files[name] = append(files[name], File{
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Size:        len(data),
+			Data:        base64.StdEncoding.EncodeToString(data),
+		})
+	}
+
+	for name, v := range values {
+		params[name] = v
+	}
+	for name, f := range files {
+		params[name] = f
+	}
+	return json.Marshal(params)
+}
@@ -0,0 +1,137 @@
+package pj
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PgError holds the fields of an error that has been reported by postgres.
+type PgError struct {
+	Code       string // SQLSTATE
+	Message    string
+	Detail     string
+	Hint       string
+	Where      string // context of the error, e.g. the line of the plv8 function
+	Constraint string
+	Err        error // the original driver error
+}
+
+func (e *PgError) Error() string {
+	return e.Err.Error()
+}
+
+// pgErrorFields maps the fields of PgError to the names of the corresponding
+// fields of the error types of the known drivers (github.com/jackc/pgx and github.com/lib/pq)
+var pgErrorFields = []struct {
+	target func(*PgError) *string
+	names  []string
+}{
+	{func(e *PgError) *string { return &e.Code }, []string{"Code"}},
+	{func(e *PgError) *string { return &e.Message }, []string{"Message"}},
+	{func(e *PgError) *string { return &e.Detail }, []string{"Detail"}},
+	{func(e *PgError) *string { return &e.Hint }, []string{"Hint"}},
+	{func(e *PgError) *string { return &e.Where }, []string{"Where"}},
+	{func(e *PgError) *string { return &e.Constraint }, []string{"ConstraintName", "Constraint"}},
+}
+
+// pgError returns the PgError for the given driver error or nil, if err is not an error reported by postgres.
+// To stay independant of the driver, the fields are read via reflection from any struct error
+// that has a string field Code with a SQLSTATE.
+func pgError(err error) *PgError {
+	if err == nil {
+		return nil
+	}
+
+	if pe, ok := err.(*PgError); ok {
+		return pe
+	}
+
+	v := reflect.ValueOf(err)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	pe := &PgError{Err: err}
+	for _, f := range pgErrorFields {
+		for _, name := range f.names {
+			fv := v.FieldByName(name)
+			if fv.IsValid() && fv.Kind() == reflect.String {
+				*f.target(pe) = fv.String()
+				break
+			}
+		}
+	}
+
+	if len(pe.Code) != 5 {
+		return nil
+	}
+	return pe
+}
+
+// raisedStatus matches the SQLSTATE or the message of errors that are raised by query functions
+// with an http status, e.g. RAISE 'not found' USING ERRCODE = 'PJ404' or plv8.elog(ERROR, 'PJ404: not found')
+var raisedStatus = regexp.MustCompile(`^(?:\w*Error: )?PJ([45]\d\d):?\s*`)
+
+// pgStatus returns the http status and the error code of the problem for the PgError pe
+// and the message that is exposed for errors raised with an http status
+func pgStatus(pe *PgError) (status int, code string, msg string) {
+	msg = pe.Message
+	if m := raisedStatus.FindStringSubmatch(pe.Code); m != nil {
+		status, _ = strconv.Atoi(m[1])
+		return status, ErrRaised, msg
+	}
+	if m := raisedStatus.FindStringSubmatch(pe.Message); m != nil {
+		status, _ = strconv.Atoi(m[1])
+		return status, ErrRaised, pe.Message[len(m[0]):]
+	}
+
+	switch {
+	case pe.Code == "23505": // unique_violation
+		return http.StatusConflict, ErrUniqueViolation, msg
+	case pe.Code == "23503": // foreign_key_violation
+		if strings.HasPrefix(pe.Message, "update or delete") {
+			// the row is still referenced
+			return http.StatusConflict, ErrForeignKeyViolation, msg
+		}
+		// the referenced row does not exist
+		return http.StatusUnprocessableEntity, ErrForeignKeyViolation, msg
+	case strings.HasPrefix(pe.Code, "23"): // integrity_constraint_violation
+		return http.StatusUnprocessableEntity, ErrConstraintViolation, msg
+	case pe.Code == "42501": // insufficient_privilege
+		return http.StatusForbidden, ErrForbidden, msg
+	case pe.Code == "P0002": // no_data_found
+		return http.StatusNotFound, ErrNotFound, msg
+	}
+	return http.StatusInternalServerError, ErrQueryFailed, msg
+}
+
+// pgProblem returns the problem for an error that postgres reported for the call of a query function.
+//
+// By default the message is exposed as detail for client errors and the hint for errors raised with an http status.
+// The SQLSTATE and the constraint name are only set, if PJ.ExposeDBError is set, which may change what is exposed.
+func (p *PJ) pgProblem(r *http.Request, pe *PgError) *Problem {
+	status, code, msg := pgStatus(pe)
+	prob := newProblem(status, code, pe)
+	if status < 500 {
+		prob.Detail = msg
+	}
+	if code == ErrRaised {
+		prob.Hint = pe.Hint
+	}
+	if p.ExposeDBError != nil {
+		prob.SQLState = pe.Code
+		prob.Constraint = pe.Constraint
+		p.ExposeDBError(r, pe, prob)
+	}
+	return prob
+}
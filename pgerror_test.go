@@ -0,0 +1,103 @@
+package pj
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPgProblem(t *testing.T) {
+	tests := []struct {
+		err    *PgError
+		status int
+		code   string
+		detail string
+	}{
+		{&PgError{Code: "23505", Message: `duplicate key value violates unique constraint "persons_email_key"`, Constraint: "persons_email_key"},
+			http.StatusConflict, ErrUniqueViolation, `duplicate key value violates unique constraint "persons_email_key"`},
+		{&PgError{Code: "23503", Message: `update or delete on table "persons" violates foreign key constraint`},
+			http.StatusConflict, ErrForeignKeyViolation, `update or delete on table "persons" violates foreign key constraint`},
+		{&PgError{Code: "23503", Message: `insert or update on table "orders" violates foreign key constraint`},
+			http.StatusUnprocessableEntity, ErrForeignKeyViolation, `insert or update on table "orders" violates foreign key constraint`},
+		{&PgError{Code: "23514", Message: "new row violates check constraint"}, http.StatusUnprocessableEntity, ErrConstraintViolation, "new row violates check constraint"},
+		{&PgError{Code: "42501", Message: "permission denied for table persons"}, http.StatusForbidden, ErrForbidden, "permission denied for table persons"},
+		{&PgError{Code: "P0002", Message: "person not found"}, http.StatusNotFound, ErrNotFound, "person not found"},
+		{&PgError{Code: "PJ410", Message: "person is gone"}, http.StatusGone, ErrRaised, "person is gone"},
+		{&PgError{Code: "XX000", Message: "Error: PJ422: name is missing"}, http.StatusUnprocessableEntity, ErrRaised, "name is missing"},
+		{&PgError{Code: "P0001", Message: "PJ503 maintenance"}, http.StatusServiceUnavailable, ErrRaised, ""},
+		{&PgError{Code: "XX000", Message: "TypeError: x is undefined"}, http.StatusInternalServerError, ErrQueryFailed, ""},
+	}
+
+	p := New(nil, map[string]string{"GET": "pj__x__get"}, nil)
+	r := httptest.NewRequest("GET", "/x", nil)
+
+	for _, test := range tests {
+		test.err.Err = errors.New(test.err.Message)
+		prob := p.dbProblem(r, test.err)
+
+		if got, want := prob.Status, test.status; got != want {
+			t.Errorf("%s %q status = %v; want %v", test.err.Code, test.err.Message, got, want)
+		}
+
+		if got, want := prob.Code, test.code; got != want {
+			t.Errorf("%s %q code = %#v; want %#v", test.err.Code, test.err.Message, got, want)
+		}
+
+		if got, want := prob.Detail, test.detail; got != want {
+			t.Errorf("%s %q detail = %#v; want %#v", test.err.Code, test.err.Message, got, want)
+		}
+
+		if prob.SQLState != "" || prob.Constraint != "" {
+			t.Errorf("%s %q must not expose the sqlstate and the constraint without ExposeDBError", test.err.Code, test.err.Message)
+		}
+	}
+}
+
+func TestExposeDBError(t *testing.T) {
+	b := &seqBackend{errs: []error{&PgError{
+		Code:       "23505",
+		Message:    `duplicate key value violates unique constraint "persons_email_key"`,
+		Constraint: "persons_email_key",
+		Err:        errors.New("unique violation"),
+	}}}
+
+	p := New(nil, map[string]string{"POST": "pj__x__post"}, nil)
+	p.Backend = b
+	p.ExposeDBError = func(r *http.Request, pe *PgError, prob *Problem) {
+		prob.Detail = "email is already taken"
+		prob.Constraint = ""
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/x", strings.NewReader("{}")))
+
+	if got, want := w.Code, http.StatusConflict; got != want {
+		t.Errorf("status = %v; want %v", got, want)
+	}
+
+	var prob map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &prob); err != nil {
+		t.Fatalf("body is no valid json: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"title":    "Conflict",
+		"status":   float64(http.StatusConflict),
+		"detail":   "email is already taken",
+		"code":     ErrUniqueViolation,
+		"sqlstate": "23505",
+	}
+
+	for k, want := range expected {
+		if got := prob[k]; got != want {
+			t.Errorf("problem %s = %#v; want %#v", k, got, want)
+		}
+	}
+
+	if _, has := prob["constraint"]; has {
+		t.Errorf("problem must not expose the constraint")
+	}
+}
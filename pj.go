@@ -13,19 +13,49 @@ This is most easily achieved by using the plv8 extension to define the functions
 
 2. All validation occurs inside the postgresql function.
 
-3. The parameter to the function is a json map created from the url query.
+3. The parameter to the function is a json map created from the url query (GET) or the request body,
+which may be json, form encoded or multipart/form-data.
 
 4. The returned json will be returned to the client.
 
 5. The returned json may have a property "http_status_code" to indicate errors. If it does the corresponding status code is sent
 to the client in addition to the json.
 
-6. The returned json may have a property "http_headers" that must be convertible to a map[string]string. If it does, the http headers
-will be set accordingly.
+6. The returned json may have a property "http_headers" that must be a map of header names to strings
+or arrays of strings (for multi-valued headers). If it does, the http headers will be set accordingly,
+as long as they are allowed, see PJ.AllowHeaders and PJ.DenyHeaders. Cookies can be set via the property "http_cookies",
+an array of Cookie objects. The property "http_redirect" redirects to the given location.
+These three properties are removed from the json that is sent to the client.
 
-7. Authentication and authorization will be handled by middleware surrounding the http.Handler returned from pj.New
+7. The returned json may have a property "http_body" with a string or "http_body_base64" with base64 encoded binary data.
+If it does, the body is sent as is instead of the json, e.g. to return a generated PDF, an image or a CSV file.
+The content type should be set via "http_headers", otherwise it is detected from the body.
 
-Benefits
+8. Authentication and authorization will be handled by middleware surrounding the http.Handler returned from pj.New
+
+9. If a request fails before the result of the function could be sent, a problem document (RFC 7807)
+with a stable error code is sent to the client, see Problem. Errors raised by postgres are mapped
+to http statuses by their SQLSTATE, e.g. unique violations to 409 Conflict. A function may raise an error
+with a custom SQLSTATE PJ400 - PJ599 (or a message starting with it) to respond with that status.
+
+10. An endpoint may have a pagination mode. Then the requested page is passed as property "page" of the params
+and the Link and X-Total-Count headers are set from the result, see Pagination.
+
+11. Rate limits per client and caps on the concurrent calls of the query functions protect the database,
+see Limits. Requests exceeding them get 429 Too Many Requests with a Retry-After header.
+
+12. Read only requests may be served by read replicas of the database, see Replicas.
+
+13. Instead of query function files, the endpoints may be read from the database, e.g. if the functions are
+deployed via migrations, see NewQueryCollectionDB.
+
+14. A query function file may start with a header comment "pj:" that holds the settings of its endpoint and
+the attributes of its postgres function as json, e.g. {"volatility": "STABLE", "cost": 50}, see FuncHeader.
+
+15. Javascript modules inside the directory _lib of the root are shared by the query functions via require,
+see LibDir.
+
+# Benefits
 
 - no mapping server<->database necessary for rows and tables
 
@@ -38,7 +68,7 @@ tables when the schema has settled
 
 - fast development of client and database without having to restart or recompile server
 
-Disadvantages
+# Disadvantages
 
 - you are bound to postgres
 
@@ -47,21 +77,26 @@ Disadvantages
 - need different connections for different access roles
 
 - learn postgres
-
 */
 package pj
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"io/fs"
+	"math"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // using hidden function in stdlib, see: https://github.com/golang/go/issues/18086
@@ -105,138 +140,400 @@ func New(db Queryer, m map[string]string, errTracker func(error, *http.Request))
 		}
 	}
 
-	return &PJ{m, db, errTracker, 2048}
+	p := &PJ{Map: m, Queryer: db, errTracker: errTracker, MaxBodySize: 2048}
+	if db != nil {
+		p.Backend = NewQueryerBackend(db)
+	}
+	return p
 }
 
+// PJ is the http.Handler that serves the query functions of a mount path.
+// HEAD requests are served by the function for GET without sending the body.
+// OPTIONS requests are answered with the Allow header and, if CORS is set, as CORS preflight requests.
 type PJ struct {
 	Map         map[string]string
 	Queryer     Queryer
+	Backend     Backend // calls the query functions, New sets it to a NewQueryerBackend for the Queryer
 	errTracker  func(error, *http.Request)
 	MaxBodySize int64 // max size of the body, defaults to 2KB
+	CORS        *CORS // CORS policy, no CORS headers are sent if nil
+
+	// Endpoints holds the settings for the query functions of the request methods, keyed by method
+	Endpoints map[string]*Endpoint
+
+	// AllowHeaders are the response headers the query functions may set via "http_headers".
+	// If empty, all headers that are not denied are allowed.
+	AllowHeaders []string
+
+	// DenyHeaders are the response headers the query functions may not set via "http_headers".
+	// If nil, DefaultDenyHeaders are denied.
+	DenyHeaders []string
+
+	// Hardened forbids the query functions to set hop-by-hop headers (e.g. Connection, Transfer-Encoding)
+	// and the Content-Length header via "http_headers"
+	Hardened bool
+
+	// PathParams returns the params that are part of the request path, e.g. as parsed by a router.
+	// They are merged into the params of the query function, see Endpoint.ParamPrecedence.
+	PathParams func(r *http.Request) map[string]string
+
+	// ErrorRenderer writes the problem document of a failed request. If nil, RenderProblem is used.
+	ErrorRenderer func(w http.ResponseWriter, r *http.Request, p *Problem)
+
+	// Replicas are the read replicas of the Backend, if not nil
+	Replicas *Replicas
+
+	// Retry is the policy for retrying calls that failed with transient database errors.
+	// If nil, the DefaultRetryPolicy is used.
+	Retry *RetryPolicy
+
+	// ExposeDBError is called with the error that postgres reported for a call of a query function
+	// and the problem that is sent to the client. It may change the fields of the problem
+	// to control which details of the error are exposed. The SQLSTATE and the constraint name
+	// are only part of the problem, if ExposeDBError is set.
+	ExposeDBError func(r *http.Request, pe *PgError, p *Problem)
+
+	// Limits is the admission control for the query functions of all methods, if not nil.
+	// Each method has its own rate limits and concurrency cap. See Endpoint.Limits for overrides.
+	Limits *Limits
+
+	// ClientID returns the identity of the client for the rate limits, e.g. an API key.
+	// If nil, the IP address of the client is used.
+	ClientID func(r *http.Request) string
+
+	// QueueObserver is called with the number of calls of the query function in flight and the
+	// number of requests waiting for a call, whenever they change for the method of the request r.
+	// It is only called for methods with a MaxInFlight limit.
+	QueueObserver func(r *http.Request, inFlight, queued int)
+
+	limitersMu sync.Mutex
+	limiters   map[string]*limiter
 }
 
-func (p *PJ) getRow(r *http.Request) (*sql.Row, error) {
-	if r.Method == "GET" {
-		b, err := json.Marshal(r.URL.Query())
-		if err != nil {
-			return nil, err
+// Endpoint holds the settings of the query function of a mount path and request method
+type Endpoint struct {
+	// MaxBodySize is the max size of the request body, if > 0. It overrides the MaxBodySize of the PJ.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// MaxInlineFileSize is the max size of a single file of a multipart/form-data request, if > 0.
+	// The files are passed base64 encoded to the query function, see File.
+	MaxInlineFileSize int64 `json:"max_inline_file_size"`
+
+	// ParamPrecedence lists the param sources (ParamsPath, ParamsBody, ParamsQuery) from the highest
+	// to the lowest precedence. Sources that are not listed are ignored. Defaults to DefaultParamPrecedence.
+	ParamPrecedence []string `json:"param_precedence"`
+
+	// Pagination enables the pagination mode of the endpoint, if not nil, see Pagination.
+	Pagination *Pagination `json:"pagination"`
+
+	// Limits overrides the Limits of the PJ for the endpoint, if not nil
+	Limits *Limits `json:"limits"`
+
+	// Signature overrides the Signature of the QueryCollection for the postgres function of the endpoint, if not nil
+	Signature *Signature `json:"signature"`
+
+	// Volatility is the volatility category of the postgres function: Volatile, Stable or Immutable.
+	// It defaults to Stable for GET and to Volatile for the other methods.
+	// Requests to Stable and Immutable functions may be served by Replicas.
+	Volatility string `json:"volatility"`
+}
+
+// endpoint returns the Endpoint for the method meth, or an empty Endpoint, if there is none
+func (p *PJ) endpoint(meth string) *Endpoint {
+	if e, has := p.Endpoints[meth]; has && e != nil {
+		return e
+	}
+	return &Endpoint{}
+}
+
+// maxBodySize returns the max size of the request body for the method meth
+func (p *PJ) maxBodySize(meth string) int64 {
+	if e := p.endpoint(meth); e.MaxBodySize > 0 {
+		return e.MaxBodySize
+	}
+	return p.MaxBodySize
+}
+
+// allow returns the value of the Allow header, i.e. the methods that are served by p
+func (p *PJ) allow() string {
+	var meths []string
+	for _, meth := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		fmeth := meth
+		if meth == "HEAD" {
+			fmeth = "GET"
 		}
-		return p.Queryer.QueryRow("SELECT "+p.Map[r.Method]+"($1)", string(b)), nil
+		if _, has := p.Map[fmeth]; has {
+			meths = append(meths, meth)
+		}
+	}
+	return strings.Join(append(meths, "OPTIONS"), ", ")
+}
+
+// method returns the method whose function serves the request
+func method(r *http.Request) string {
+	if r.Method == "HEAD" {
+		return "GET"
 	}
-	defer r.Body.Close()
+	return r.Method
+}
 
-	b, err := ioutil.ReadAll(io.LimitReader(r.Body, p.MaxBodySize))
+// input returns the params of the query function for the request r. If the endpoint has a pagination mode,
+// the requested page is added to the params and returned as well.
+func (p *PJ) input(r *http.Request) (b []byte, page *Page, err error) {
+	meth := method(r)
+	b, err = p.params(r, meth)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if pg := p.endpoint(meth).Pagination; pg != nil {
+		page, err = pg.page(r.URL.Query())
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err = addPage(b, page)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
+	return b, page, nil
+}
 
-	// just validate the json should be fast, see https://github.com/golang/go/issues/5683
-	// var x struct{}
-	// err = json.Unmarshal(b, &x)
-	// improved performance, based on https://github.com/golang/go/issues/18086
-	err = isValidJSON(b)
+// call calls the query function for the request r with the params b and returns its result
+func (p *PJ) call(r *http.Request, b []byte) (result []byte, err error) {
+	meth := method(r)
+	result, onReplica, err := p.callReplica(r, meth, p.Map[meth], b)
+	if !onReplica {
+		result, err = p.callPrimary(r, meth, p.Map[meth], b)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	return p.Queryer.QueryRow("SELECT "+p.Map[r.Method]+"($1)", string(b)), nil
+// renderProblem passes the problem to the errTracker and writes it via the ErrorRenderer
+func (p *PJ) renderProblem(w http.ResponseWriter, r *http.Request, prob *Problem) {
+	if p.errTracker != nil {
+		p.errTracker(prob, r)
+	}
+	if p.ErrorRenderer != nil {
+		p.ErrorRenderer(w, r, prob)
+		return
+	}
+	RenderProblem(w, r, prob)
 }
 
 func (p *PJ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var (
 		err     error
-		row     *sql.Row
+		release func()
+		page    *Page
 		code    int
-		headers map[string]string
+		headers http.Header
+		cookies []*http.Cookie
 		b       []byte
 		resp    map[string]interface{}
+		body    []byte // the raw body, if the result has http_body or http_body_base64
 	)
 
+	if p.CORS != nil {
+		p.CORS.setHeaders(w.Header(), r, p.allow())
+	}
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", p.allow())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 steps:
 	for jump := 1; err == nil; jump++ {
 		switch jump - 1 {
 		default:
 			break steps
 		case 0:
-			if _, found := p.Map[r.Method]; !found {
-				code = http.StatusMethodNotAllowed
-				err = errors.New("no query found for method")
-			} else {
-				row, err = p.getRow(r)
+			if _, found := p.Map[method(r)]; !found {
+				w.Header().Set("Allow", p.allow())
+				err = newProblem(http.StatusMethodNotAllowed, ErrMethodNotAllowed, errors.New("no query found for method "+r.Method))
+				break
+			}
+			// rate limited requests are rejected before their body is read and the body is read
+			// within its limits before the request waits for a call of the query function
+			err = p.rateLimit(w, r)
+			if err == nil {
+				b, page, err = p.input(r)
+			}
+			if err == nil {
+				release, err = p.admit(w, r)
 			}
 		case 1:
-			b = []byte{}
-			err = row.Scan(&b)
+			b, err = p.call(r, b)
+			release()
 		case 2:
+			if len(b) == 0 {
+				err = newProblem(http.StatusBadRequest, ErrInvalidParams, errors.New("query function returned no result"))
+				break
+			}
 			resp = map[string]interface{}{}
 			err = json.Unmarshal(b, &resp)
 			if err != nil {
-				code = http.StatusInternalServerError
+				err = newProblem(http.StatusInternalServerError, ErrInvalidResponse, err)
 			}
 		case 3:
 			if c, has := resp["http_status_code"]; has {
 				delete(resp, "http_status_code")
 				code, err = parseStatusCode(c)
+				if err != nil {
+					err = newProblem(http.StatusInternalServerError, ErrInvalidStatusCode, err)
+				}
 			}
 		case 4:
 			if c, has := resp["http_headers"]; has {
 				delete(resp, "http_headers")
-				headers, err = parseHeaders(c)
+				headers, err = p.parseHeaders(c)
+				if err != nil {
+					err = newProblem(http.StatusInternalServerError, ErrInvalidHeaders, err)
+				}
+			}
+		case 5:
+			if c, has := resp["http_cookies"]; has {
+				delete(resp, "http_cookies")
+				cookies, err = parseCookies(c)
+				if err != nil {
+					err = newProblem(http.StatusInternalServerError, ErrInvalidCookies, err)
+				}
+			}
+		case 6:
+			if c, has := resp["http_redirect"]; has {
+				delete(resp, "http_redirect")
+				var location string
+				location, code, err = parseRedirect(c, method(r), code)
+				if err != nil {
+					err = newProblem(http.StatusInternalServerError, ErrInvalidRedirect, err)
+					break
+				}
+				if headers == nil {
+					headers = http.Header{}
+				}
+				headers.Set("Location", location)
+			}
+		case 7:
+			body, err = parseBody(resp)
+			if err != nil {
+				err = newProblem(http.StatusInternalServerError, ErrInvalidBody, err)
+			}
+		case 8:
+			if page == nil {
+				break
+			}
+			var ph http.Header
+			ph, err = p.endpoint(method(r)).Pagination.headers(r.URL, page, resp)
+			if err != nil {
+				err = newProblem(http.StatusInternalServerError, ErrInvalidResponse, err)
+				break
+			}
+			if headers == nil {
+				headers = http.Header{}
+			}
+			// headers set by the query function win
+			for k, v := range ph {
+				if _, has := headers[k]; !has {
+					headers[k] = v
+				}
+			}
+		case 9:
+			if body != nil {
+				break
+			}
+			b, err = stripResponseProps(b)
+			if err != nil {
+				err = newProblem(http.StatusInternalServerError, ErrInvalidResponse, err)
 			}
 		}
 	}
 
 	if err != nil {
-		if p.errTracker != nil {
-			p.errTracker(err, r)
-		}
-		if code == 0 {
-			code = http.StatusBadRequest
+		prob, ok := err.(*Problem)
+		if !ok {
+			prob = newProblem(http.StatusBadRequest, ErrBadRequest, err)
 		}
-	} else {
-		if code == 0 {
-			code = http.StatusOK
+		if prob.Status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			w.Header().Set("Retry-After", "1")
 		}
+		p.renderProblem(w, r, prob)
+		return
 	}
 
-	if len(headers) > 0 {
-		for k, v := range headers {
-			w.Header().Set(k, v)
-		}
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	for k, v := range headers {
+		w.Header()[http.CanonicalHeaderKey(k)] = v
 	}
 
-	if len(b) == 0 {
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+	}
+
+	if p.Replicas != nil && !p.readOnly(method(r)) && code < 400 {
+		p.Replicas.pin(w, time.Now())
+	}
+
+	switch {
+	case body == nil:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	case w.Header().Get("Content-Type") == "":
+		w.Header().Set("Content-Type", http.DetectContentType(body))
+		fallthrough
+	default:
+		b = body
+	}
+
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.WriteHeader(code)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
 	w.Write(b)
 }
 
-func parseStatusCode(v interface{}) (code int, err error) {
-	f, ok := v.(float64)
-	if !ok {
-		err = errors.New("http_error_code is not a float64")
-		return
+// parseBody returns the raw body of the result, if it has the property "http_body" (a string that is sent as is)
+// or "http_body_base64" (base64 encoded binary data). It returns nil, if the result has none of them.
+func parseBody(resp map[string]interface{}) (body []byte, err error) {
+	if v, has := resp["http_body"]; has {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("http_body is not a string")
+		}
+		return []byte(s), nil
 	}
-	return int(f), nil
+
+	if v, has := resp["http_body_base64"]; has {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("http_body_base64 is not a string")
+		}
+		return base64.StdEncoding.DecodeString(s)
+	}
+
+	return nil, nil
 }
 
-func parseHeaders(v interface{}) (headers map[string]string, err error) {
-	h, ok := v.(map[string]interface{})
+// parseStatusCode returns the status code of the "http_status_code" property of a result.
+// It must be an integral number between 100 and 599.
+func parseStatusCode(v interface{}) (code int, err error) {
+	f, ok := v.(float64)
 	if !ok {
-		// fmt.Printf("%#v (%T)\n", h, h)
-		err = errors.New("http_headers is not a map[string]string")
+		err = errors.New("http_status_code is not a number")
 		return
 	}
-
-	r := map[string]string{}
-
-	for k, v := range h {
-		r[k] = fmt.Sprintf("%v", v)
+	if f != math.Trunc(f) || f < 100 || f > 599 {
+		err = fmt.Errorf("http_status_code %v is not an integer between 100 and 599", f)
+		return
 	}
-
-	return r, nil
+	return int(f), nil
 }
 
 // QueryRow requeries the given function qFn with the given parameter jsonParam and scans the result into the target
@@ -260,38 +557,105 @@ type Muxer interface {
 }
 
 type QueryCollection struct {
-	RootDir    string
+	// RootDir is the directory of the query function files on the local filesystem.
+	// It is empty, if the QueryCollection has been created by NewQueryCollectionFS.
+	RootDir string
+
+	// FS is the file system that the query function files are read from.
+	// It is nil, if the QueryCollection has been created by NewQueryCollectionDB.
+	FS fs.FS
+
 	Queries    map[string]map[string]string
 	Handlers   map[string]*PJ
 	errTracker func(error, *http.Request)
 	*sync.Mutex
+
+	// ProbeParams is the json that each function is called with after it has been deployed
+	// in order to find runtime errors early. The call is rolled back. If ProbeParams is empty
+	// (the default), the functions are not probed.
+	ProbeParams string
+
+	// CORS is the default CORS policy of the http handlers, see MountConfig for overrides per mount path
+	CORS *CORS
+
+	// ErrorRenderer is the ErrorRenderer of the http handlers
+	ErrorRenderer func(w http.ResponseWriter, r *http.Request, p *Problem)
+
+	// Hardened is the Hardened mode of the http handlers
+	Hardened bool
+
+	// Backend is the Backend of the http handlers, if not nil
+	Backend Backend
+
+	// Replicas are the Replicas of the http handlers, if not nil
+	Replicas *Replicas
+
+	// Retry is the RetryPolicy of the http handlers
+	Retry *RetryPolicy
+
+	// ExposeDBError is the ExposeDBError hook of the http handlers
+	ExposeDBError func(r *http.Request, pe *PgError, p *Problem)
+
+	// Signature is the default Signature of the postgres functions, see MountConfig for overrides per query function
+	Signature Signature
+
+	// Limits are the default Limits of the http handlers, see MountConfig for overrides per mount path
+	Limits *Limits
+
+	// ClientID is the ClientID of the http handlers
+	ClientID func(r *http.Request) string
+
+	// QueueObserver is the QueueObserver of the http handlers
+	QueueObserver func(r *http.Request, inFlight, queued int)
+
+	maxBodySize int64
+	registry    string // the registry source, if the endpoints are read from the database
 }
 
+// NewQueryCollection creates a QueryCollection for the query function files inside the directory rootDir
+// of the local filesystem
 func NewQueryCollection(rootDir string, errTracker func(error, *http.Request)) (*QueryCollection, error) {
-	pattern := filepath.Join(rootDir, "[a-z][a-z_0-9]*", "[a-z][a-z]*", "[a-z][a-z_0-9]*.sql")
-	// fmt.Printf("pattern: %#v\n", pattern)
-	files, err := filepath.Glob(pattern)
+	q, err := NewQueryCollectionFS(os.DirFS(rootDir), errTracker)
 	if err != nil {
 		return nil, err
 	}
+	q.RootDir = rootDir
+	return q, nil
+}
 
-	fmt.Printf("files: %#v\n", files)
-
+// NewQueryCollectionFS creates a QueryCollection for the query function files inside the given file system,
+// e.g. an embed.FS. See LoadQueries for the expected layout.
+func NewQueryCollectionFS(fsys fs.FS, errTracker func(error, *http.Request)) (*QueryCollection, error) {
 	var queries = map[string]map[string]string{}
 
-	for _, f := range files {
-		rel, err := filepath.Rel(rootDir, f)
+	err := fs.WalkDir(fsys, ".", func(f string, d fs.DirEntry, err error) error {
 		if err != nil {
-			fmt.Printf("Err filepath Rel: %s\n", rel)
-			return nil, err
+			return err
+		}
+
+		// skip hidden directories and directories starting with an underscore
+		if d.IsDir() {
+			if f != "." && (strings.HasPrefix(d.Name(), ".") || strings.HasPrefix(d.Name(), "_")) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// files that are not query function files or not inside a method directory are ignored
+		if path.Ext(f) != ".sql" || strings.Count(f, "/") < 2 {
+			return nil
 		}
 
-		var mntp, meth, fname string
+		// as are sql files that are not inside a directory of a request method, e.g. migrations/v1/up/001-init.sql
+		switch path.Base(path.Dir(f)) {
+		case "get", "post", "put", "patch", "delete":
+		default:
+			return nil
+		}
 
-		mntp, meth, fname, err = splitRelPath(rel)
+		mntp, meth, fname, err := splitRelPath(f)
 		if err != nil {
-			fmt.Printf("Err splitRelPath Rel: %s\n", rel)
-			return nil, err
+			return err
 		}
 
 		if _, has := queries[mntp]; !has {
@@ -299,69 +663,180 @@ func NewQueryCollection(rootDir string, errTracker func(error, *http.Request)) (
 		}
 
 		if _, has := queries[mntp][meth]; has {
-			return nil, errors.New("more than one query function for " + meth + " /" + mntp)
+			return errors.New("more than one query function for " + meth + " /" + mntp)
+		}
+
+		if other := findQuery(queries, meth, fname); other != "" {
+			return errors.New("query function " + fname + " for " + meth + " /" + mntp + " is already used for /" + other)
 		}
 
 		queries[mntp][meth] = fname
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return &QueryCollection{rootDir, queries, map[string]*PJ{}, errTracker, &sync.Mutex{}}, nil
+	return &QueryCollection{
+		FS:          fsys,
+		Queries:     queries,
+		Handlers:    map[string]*PJ{},
+		errTracker:  errTracker,
+		Mutex:       &sync.Mutex{},
+		maxBodySize: 2048,
+	}, nil
 }
 
+// EachFile calls fn for each query function file. The filepath is relative to the FS and slash separated.
 func (q *QueryCollection) EachFile(fn func(filepath, funcname, meth string)) {
 	for mntp, m := range q.Queries {
 		for meth, fname := range m {
-			fn(filepath.Join(q.RootDir, mntp, strings.ToLower(meth), fname+".sql"), fname, strings.ToLower(meth))
+			fn(path.Join(mntp, strings.ToLower(meth), fname+".sql"), fname, strings.ToLower(meth))
 		}
 	}
 }
 
 // RegisterQueryFuncs reads  the content of all query function files and
-// execs them on the db
-func (q *QueryCollection) RegisterQueryFuncs(db DB) (err error) {
+// execs them on the db. It returns the executed sql statements.
+// If dryRun is true, the statements are returned without executing them and db may be nil.
+func (q *QueryCollection) RegisterQueryFuncs(db DB, dryRun bool) (stmts []string, err error) {
+	if q.FS == nil {
+		return nil, errNoFiles
+	}
 	q.Lock()
 	defer q.Unlock()
+
+	mods, err := q.libs()
+	if err != nil {
+		return nil, err
+	}
+
+	if stmt := libSql(mods); stmt != "" {
+		stmts = append(stmts, stmt)
+		if !dryRun {
+			if _, err = db.Exec(stmt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	q.EachFile(func(filepath, funcname, meth string) {
 		if err != nil {
 			return
 		}
-		var c []byte
-
-		fmt.Printf("initial reading of file: %#v\n", filepath)
-
-		c, err = ioutil.ReadFile(filepath)
+		var stmt string
+		stmt, err = q.deployFile(db, filepath, meth, funcname, mods, dryRun)
 		if err != nil {
 			return
 		}
+		stmts = append(stmts, stmt)
+	})
+	if err != nil {
+		return
+	}
 
-		_, err = db.Exec(Sql(meth, funcname, c))
+	if stmt := pruneLibSql(mods); stmt != "" {
+		stmts = append(stmts, stmt)
+		if !dryRun {
+			_, err = db.Exec(stmt)
+		}
+	}
+	return
+}
 
+// DropQueryFuncs drops the postgres functions of all query function files
+// that exist in the db
+func (q *QueryCollection) DropQueryFuncs(db DB) (err error) {
+	if q.FS == nil {
+		return errNoFiles
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.EachFile(func(filepath, funcname, meth string) {
 		if err != nil {
 			return
 		}
-
+		_, err = db.Exec(dropFuncs(FuncName(meth, funcname), nil))
 	})
 
 	return
 }
 
+// funcMap returns the map of request methods to postgres function names for the given
+// map of request methods to query functions of the Queries
+func (q *QueryCollection) funcMap(m map[string]string) map[string]string {
+	fm := make(map[string]string, len(m))
+	for meth, fname := range m {
+		if q.registry != "" {
+			fm[meth] = fname
+			continue
+		}
+		fm[meth] = FuncName(meth, fname)
+	}
+	return fm
+}
+
 func (q *QueryCollection) RegisterHTTPHandlers(mux Muxer, db Queryer, maxBodySize int64) (err error) {
 	if maxBodySize < 0 {
 		maxBodySize = 2048 // default
 	}
 	q.Lock()
 	defer q.Unlock()
-	for mntp, m := range q.Queries {
-		h := New(db, m, q.errTracker)
-		h.MaxBodySize = maxBodySize
+	q.maxBodySize = maxBodySize
+	for mntp := range q.Queries {
+		h, err := q.handler(db, mntp)
+		if err != nil {
+			return err
+		}
 		q.Handlers[mntp] = h
 		mux.Handle(mntp, h)
 	}
 	return nil
 }
 
+// handler returns a new http handler for the query functions of the mount path mntp.
+// If the mount path already has a handler, its Backend and its limiters are taken over,
+// so that the prepared statements and the rate limits survive updates.
+func (q *QueryCollection) handler(db Queryer, mntp string) (*PJ, error) {
+	pj := New(db, q.funcMap(q.Queries[mntp]), q.errTracker)
+	if old, has := q.Handlers[mntp]; has {
+		pj.Backend = old.Backend
+		old.limitersMu.Lock()
+		pj.limiters = make(map[string]*limiter, len(old.limiters))
+		for meth, li := range old.limiters {
+			pj.limiters[meth] = li
+		}
+		old.limitersMu.Unlock()
+	}
+	err := q.configure(pj, mntp)
+	if err != nil {
+		return nil, err
+	}
+	return pj, nil
+}
+
+// swap replaces the http handler of the mount path mntp by a new one for the current query functions
+// and settings. Handlers are never changed while they are serving, requests that are being served
+// by the old handler are not affected.
+func (q *QueryCollection) swap(mux Muxer, mntp string) error {
+	old, has := q.Handlers[mntp]
+	if !has {
+		return errors.New("query functions of /" + mntp + " have no http handler")
+	}
+	pj, err := q.handler(old.Queryer, mntp)
+	if err != nil {
+		return err
+	}
+	q.Handlers[mntp] = pj
+	mux.Handle(mntp, pj)
+	return nil
+}
+
 func (q *QueryCollection) RemoveQuery(mux Muxer, db DB, relpath string) error {
-	fmt.Printf("RemoveQuery called\n")
+	if q.FS == nil {
+		return errNoFiles
+	}
 	q.Lock()
 	defer q.Unlock()
 	mntp, meth, fname, err := splitRelPath(relpath)
@@ -393,40 +868,36 @@ func (q *QueryCollection) RemoveQuery(mux Muxer, db DB, relpath string) error {
 		return errors.New("query function for " + meth + "/" + mntp + " has not the name " + fname)
 	}
 
-	sql := fmt.Sprintf("DROP FUNCTION %s(json)", fname)
-	fmt.Printf("running: %#v\n", sql)
-	_, err = db.Exec(sql)
+	_, err = db.Exec(dropFuncs(FuncName(meth, fname), nil))
 	if err != nil {
 		return err
 	}
+	q.invalidate(mntp, FuncName(meth, fname))
 
 	if len(m) == 1 {
 		delete(q.Queries, mntp)
-	} else {
-		delete(m, meth)
-	}
-
-	if len(pj.Map) == 1 {
 		delete(q.Handlers, mntp)
 		mux.RemoveHandler(mntp)
-	} else {
-		delete(pj.Map, meth)
-		mux.Handle(mntp, pj)
+		return nil
 	}
-	return nil
+
+	delete(m, meth)
+	return q.swap(mux, mntp)
 
 }
 
 func (q *QueryCollection) UpdateQuery(mux Muxer, db DB, relpath string) error {
+	if q.FS == nil {
+		return errNoFiles
+	}
 	q.Lock()
 	defer q.Unlock()
-	fmt.Printf("UpdateQuery called\n")
 	mntp, meth, fname, err := splitRelPath(relpath)
 	if err != nil {
 		return err
 	}
 
-	f := filepath.Join(q.RootDir, relpath)
+	f := filepath.ToSlash(relpath)
 
 	pj, haspj := q.Handlers[mntp]
 	if !haspj {
@@ -452,32 +923,51 @@ func (q *QueryCollection) UpdateQuery(mux Muxer, db DB, relpath string) error {
 		return errors.New("query function for " + meth + "/" + mntp + " has not the name " + fname)
 	}
 
-	var c []byte
-
-	c, err = ioutil.ReadFile(f)
+	mods, err := q.libs()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(Sql(meth, fname, c))
+
+	_, err = q.deployFile(db, f, meth, fname, mods, false)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	q.invalidate(mntp, FuncName(meth, fname))
+
+	// apply the changed header of the file
+	return q.swap(mux, mntp)
+}
+
+// findQuery returns the mount path that uses the query function fname for the method meth
+// or an empty string, if there is none
+func findQuery(queries map[string]map[string]string, meth, fname string) string {
+	for mntp, m := range queries {
+		if m[meth] == fname {
+			return mntp
+		}
+	}
+	return ""
 }
 
+// validName matches the valid names of mount path segments and query functions
+var validName = regexp.MustCompile("^[a-z][a-z_0-9]*$")
+
 func checkRelPath(p string) error {
-	return nil
-	pattern := filepath.Join("[a-z][a-z_0-9]*", "[a-z][a-z]*", "[a-z][a-z_0-9]*.sql")
-	// pattern = filepath.Join("[a-z][a-z_0-9]*")
-	// p = "/" + p
-	// fmt.Printf("trying to match %#v against the pattern %#v\n", p, pattern)
-	is, err := filepath.Match("/"+pattern, "/"+p)
-	if err != nil {
-		panic(err.Error())
+	parr := strings.Split(p, "/")
+	if len(parr) < 3 {
+		return errors.New("invalid path " + p + ": must be [mountpath]/[method]/[queryfn].sql")
+	}
+
+	for _, seg := range parr[:len(parr)-2] {
+		if !validName.MatchString(seg) {
+			return errors.New("invalid path " + p + ": invalid mount path segment " + seg)
+		}
 	}
-	if !is {
-		return errors.New("invalid path")
+
+	file := parr[len(parr)-1]
+	if path.Ext(file) != ".sql" || !validName.MatchString(withoutExt(file)) {
+		return errors.New("invalid path " + p + ": invalid query function file " + file)
 	}
 	return nil
 }
@@ -490,21 +980,18 @@ func withoutExt(file string) string {
 	return file[:idx]
 }
 
+// splitRelPath splits the path of a query function file relative to the root into the mount path,
+// the request method and the name of the query function.
+// The mount path consists of all directories before the method directory, joined by a slash.
 func splitRelPath(p string) (mntp string, meth string, fname string, err error) {
+	p = filepath.ToSlash(p)
 	err = checkRelPath(p)
 	if err != nil {
 		return
 	}
 
-	parr := strings.Split(p, string(filepath.Separator))
-
-	// fmt.Printf("parr: %#v\n", parr)
-	if len(parr) != 3 {
-		err = errors.New("invalid path")
-		return
-	}
-
-	mntp, meth, fname = parr[0], parr[1], parr[2]
+	parr := strings.Split(p, "/")
+	mntp, meth, fname = strings.Join(parr[:len(parr)-2], "/"), parr[len(parr)-2], parr[len(parr)-1]
 	switch meth {
 	case "get", "post", "put", "patch", "delete":
 	default:
@@ -518,7 +1005,9 @@ func splitRelPath(p string) (mntp string, meth string, fname string, err error)
 
 // AddQuery adds a query that is a file located in the path relative to the rootdir
 func (q *QueryCollection) AddQuery(mux Muxer, db DB, relpath string) error {
-	fmt.Printf("AddQuery called\n")
+	if q.FS == nil {
+		return errNoFiles
+	}
 	q.Lock()
 	defer q.Unlock()
 	mntp, meth, fname, err := splitRelPath(relpath)
@@ -526,82 +1015,73 @@ func (q *QueryCollection) AddQuery(mux Muxer, db DB, relpath string) error {
 		return err
 	}
 
-	// fmt.Printf("mntp: %#v, meth: %#v, fname: %#v\n", mntp, meth, fname)
+	if other := findQuery(q.Queries, meth, fname); other != "" {
+		return errors.New("query function " + fname + " for " + meth + " /" + mntp + " is already used for /" + other)
+	}
 
-	f := filepath.Join(q.RootDir, relpath)
+	f := filepath.ToSlash(relpath)
 
-	if m, hasm := q.Queries[mntp]; hasm {
+	m, hasm := q.Queries[mntp]
+	if hasm {
 		if _, has := m[meth]; has {
 			return errors.New("query function for " + meth + " /" + mntp + " already exists")
 		}
 
-		pj, haspj := q.Handlers[mntp]
-		if !haspj {
+		if _, haspj := q.Handlers[mntp]; !haspj {
 			return errors.New("query function for " + meth + "/" + mntp + " has no http handler")
 		}
+	}
 
-		/*
-			_, hashtm := pj.Map[meth]
-			if !hashtm {
-				return errors.New("http.Handler for " + "/" + mntp + " does not handle " + meth)
-			}
-		*/
+	mods, err := q.libs()
+	if err != nil {
+		return err
+	}
 
-		var c []byte
+	_, err = q.deployFile(db, f, meth, fname, mods, false)
+	if err != nil {
+		return err
+	}
 
-		c, err = ioutil.ReadFile(f)
+	if hasm {
+		m[meth] = fname
+		err = q.swap(mux, mntp)
 		if err != nil {
-			return err
-		}
-		_, err = db.Exec(Sql(meth, fname, c))
-		if err != nil {
-			return err
+			delete(m, meth)
 		}
-
-		pj.Map[meth] = fname
-
-		mux.Handle(mntp, pj)
-		return nil
-	}
-
-	var c []byte
-
-	c, err = ioutil.ReadFile(f)
-	if err != nil {
 		return err
 	}
-	_, err = db.Exec(Sql(meth, fname, c))
+
+	q.Queries[mntp] = map[string]string{meth: fname}
+	pj, err := q.handler(db, mntp)
 	if err != nil {
+		delete(q.Queries, mntp)
 		return err
 	}
 
-	m := map[string]string{meth: fname}
-	q.Queries[mntp] = m
-
-	pj := New(db, m, q.errTracker)
 	q.Handlers[mntp] = pj
 	mux.Handle(mntp, pj)
 	return nil
 }
 
 // LoadQueries loads queries from a filesystem and registers http handlers for them
-// It expects the following directory structure of rootDir:
+// It expects the following directory structure of rootDir (or the root of the fs.FS for LoadQueriesFS):
 //
-//    [mountpath]/[method]/[queryfn].sql
+//	[mountpath]/[method]/[queryfn].sql
 //
-// for example: persons/get/all_persons.sql
+// for example: persons/get/all_persons.sql or api/v1/persons/get/all_persons.sql
 //
-// [mountpath] must be a single path segment (directory) and match the regexp [a-z][a-z_0-9]+.
+// [mountpath] consists of one or more path segments (directories), e.g. api/v1/persons, that each match the regexp [a-z][a-z_0-9]+.
+// Directories starting with a dot or an underscore are ignored, except the LibDir with the shared modules.
 // [method] must be the http request method, i.e. one of "get", "put", "patch", "delete", "post"
 // [queryfn] must match the regexp [a-z][a-z_0-9]+ and is the name of the postgresql function
 // the content of [queryfn].sql is the sql that is transferred to the database when the query is registered
 // E.g.: If the filename is all_persons.sql the content must be something like
 //
-//     CREATE OR REPLACE FUNCTION all_persons(params json) RETURNS text AS $function$
-//	   var o = {};
-//     /* do your thing */
-//     return JSON.stringify(o);
-//     $function$ LANGUAGE plv8 IMMUTABLE STRICT;
+//	    CREATE OR REPLACE FUNCTION all_persons(params json) RETURNS text AS $function$
+//		   var o = {};
+//	    /* do your thing */
+//	    return JSON.stringify(o);
+//	    $function$ LANGUAGE plv8 STABLE STRICT;
 //
 // mux is the Muxer that is used to register the http.Handlers serving the queries
 // NewQueryCollection(rootDir string, errTracker func(error, *http.Request)) (*QueryCollection, error)
@@ -612,32 +1092,52 @@ func LoadQueries(rootDir string, mux Muxer, db DB, maxBodySize int64, errTracker
 		return nil, err
 	}
 
-	err = qc.RegisterQueryFuncs(db)
-
+	err = qc.load(mux, db, maxBodySize)
 	if err != nil {
 		return nil, err
 	}
+	return qc, nil
+}
+
+// LoadQueriesFS is like LoadQueries but reads the query function files from the given file system, e.g. an embed.FS
+func LoadQueriesFS(fsys fs.FS, mux Muxer, db DB, maxBodySize int64, errTracker func(error, *http.Request)) (*QueryCollection, error) {
+	qc, err := NewQueryCollectionFS(fsys, errTracker)
 
-	err = qc.RegisterHTTPHandlers(mux, db, maxBodySize)
 	if err != nil {
 		return nil, err
 	}
 
+	err = qc.load(mux, db, maxBodySize)
+	if err != nil {
+		return nil, err
+	}
 	return qc, nil
 }
 
+func (q *QueryCollection) load(mux Muxer, db DB, maxBodySize int64) error {
+	_, err := q.RegisterQueryFuncs(db, false)
+
+	if err != nil {
+		return err
+	}
+
+	return q.RegisterHTTPHandlers(mux, db, maxBodySize)
+}
+
+// FuncName returns the name of the postgres function for the query function fname
+// that is served for the request method meth
+func FuncName(meth, fname string) string {
+	return "pj__" + fname + "__" + strings.ToLower(meth)
+}
+
+// Sql returns the sql that creates or replaces the postgres function for the query function fname
+// that is served for the request method meth with the DefaultSignature. fbody is the content of the query function file.
 func Sql(meth, fname string, fbody []byte) string {
-	return fmt.Sprintf(`
-CREATE OR REPLACE FUNCTION pj__%s__%s(params json) RETURNS text AS $function$
-	if (typeof params != 'object')
-		return NULL;
-  
-  var response = {};
-  response["http_status_code"] = 200;
-	response["results"] = [];
-	%s
-  return JSON.stringify(response);
-
-$function$ LANGUAGE plv8 IMMUTABLE STRICT;
-`, fname, meth, string(fbody))
+	return DefaultSignature.Sql(meth, fname, fbody)
+}
+
+// FuncSource returns the source of the postgres function with the DefaultSignature as it is stored in pg_proc.prosrc
+// for the given content of a query function file
+func FuncSource(fbody []byte) string {
+	return DefaultSignature.FuncSource(fbody)
 }
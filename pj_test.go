@@ -0,0 +1,845 @@
+package pj
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestNewQueryCollectionFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"persons/get/all_persons.sql":   {Data: []byte("response.results = [];")},
+		"persons/post/add_person.sql":   {Data: []byte("response.results = [params];")},
+		"README.md":                     {Data: []byte("not a query")},
+		"migrations/v1/up/001-init.sql": {Data: []byte("CREATE TABLE persons ();")},
+		"persons/gett/all_persons.sql":  {Data: []byte("response.results = [];")},
+	}
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	if got, want := q.Queries["persons"]["GET"], "all_persons"; got != want {
+		t.Errorf("Queries[persons][GET] = %#v; want %#v", got, want)
+	}
+
+	if got, want := q.Queries["persons"]["POST"], "add_person"; got != want {
+		t.Errorf("Queries[persons][POST] = %#v; want %#v", got, want)
+	}
+
+	if got, want := len(q.Queries), 1; got != want {
+		t.Errorf("len(Queries) = %v; want %v: sql files outside of method directories must be ignored", got, want)
+	}
+
+	qc, err := LoadQueriesFS(fstest.MapFS{"persons/get/all_persons.sql": {Data: []byte(`/* pj: {"cost": -1} */`)}}, testMux{}, nil, 0, nil)
+	if qc != nil || err == nil {
+		t.Errorf("LoadQueriesFS() with invalid header = %v, %v; want nil and error", qc, err)
+	}
+
+	for _, file := range []string{"persons/get/All_persons.sql", "api/V1/persons/get/all.sql"} {
+		_, err := NewQueryCollectionFS(fstest.MapFS{file: {Data: []byte("response.results = [];")}}, nil)
+		if err == nil {
+			t.Errorf("NewQueryCollectionFS() with %s must return error", file)
+		}
+	}
+
+	stmts, err := q.RegisterQueryFuncs(nil, true)
+	if err != nil {
+		t.Fatalf("RegisterQueryFuncs(nil, true) returned error: %s", err)
+	}
+
+	if got, want := len(stmts), 2; got != want {
+		t.Fatalf("len(RegisterQueryFuncs(nil, true)) = %v; want %v", got, want)
+	}
+
+	for _, stmt := range stmts {
+		if !strings.Contains(stmt, "pj__all_persons__get(params json)") && !strings.Contains(stmt, "pj__add_person__post(params json)") {
+			t.Errorf("unexpected statement %#v", stmt)
+		}
+	}
+}
+
+func TestSplitRelPath(t *testing.T) {
+
+	tests := []struct {
+		input string
+		mntp  string
+		meth  string
+		fname string
+		valid bool
+	}{
+		{"persons/get/all_persons.sql", "persons", "GET", "all_persons", true},
+		{"api/v1/persons/post/add_person.sql", "api/v1/persons", "POST", "add_person", true},
+		{"get/all_persons.sql", "", "", "", false},
+		{"persons/gett/all_persons.sql", "", "", "", false},
+		{"api/V1/persons/get/all_persons.sql", "", "", "", false},
+		{"persons/get/all-persons.sql", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		mntp, meth, fname, err := splitRelPath(test.input)
+
+		if got, want := err == nil, test.valid; got != want {
+			t.Errorf("splitRelPath(%#v) error = %v; want valid: %v", test.input, err, want)
+			continue
+		}
+
+		if got, want := mntp+" "+meth+" "+fname, test.mntp+" "+test.meth+" "+test.fname; test.valid && got != want {
+			t.Errorf("splitRelPath(%#v) = %#v; want %#v", test.input, got, want)
+		}
+	}
+}
+
+func TestOptionsAndHead(t *testing.T) {
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT pj__all_persons__get($1)": testResult(`{"results":[1,2]}`),
+	})
+	p := New(db, map[string]string{"GET": "pj__all_persons__get", "POST": "pj__add_person__post"}, nil)
+	p.CORS = &CORS{AllowOrigins: []string{"https://example.com"}, MaxAge: 600}
+
+	r := httptest.NewRequest("OPTIONS", "/persons", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"Allow", "GET, HEAD, POST, OPTIONS"},
+		{"Access-Control-Allow-Origin", "https://example.com"},
+		{"Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS"},
+		{"Access-Control-Max-Age", "600"},
+		{"Access-Control-Allow-Credentials", ""},
+	}
+
+	if got, want := w.Code, http.StatusNoContent; got != want {
+		t.Errorf("OPTIONS status = %v; want %v", got, want)
+	}
+
+	for _, test := range tests {
+		if got, want := w.Header().Get(test.header), test.expected; got != want {
+			t.Errorf("OPTIONS header %s = %#v; want %#v", test.header, got, want)
+		}
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/persons", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if got, want := w.Header().Get("Access-Control-Allow-Origin"), ""; got != want {
+		t.Errorf("OPTIONS from other origin: Access-Control-Allow-Origin = %#v; want %#v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/persons", nil))
+	length := w.Body.Len()
+
+	r = httptest.NewRequest("HEAD", "/persons", nil)
+	r.Header.Set("Origin", "https://example.com")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Errorf("HEAD status = %v; want %v", got, want)
+	}
+	if got, want := w.Body.Len(), 0; got != want {
+		t.Errorf("HEAD body length = %v; want %v", got, want)
+	}
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(length); got != want {
+		t.Errorf("HEAD Content-Length = %#v; want %#v", got, want)
+	}
+	if got, want := w.Header().Get("Access-Control-Allow-Origin"), "https://example.com"; got != want {
+		t.Errorf("HEAD Access-Control-Allow-Origin = %#v; want %#v", got, want)
+	}
+
+	// the origin * never allows requests with credentials
+	p.CORS = &CORS{AllowOrigins: []string{"*"}, AllowCredentials: true}
+	r = httptest.NewRequest("GET", "/persons", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if got, want := w.Header().Get("Access-Control-Allow-Origin"), ""; got != want {
+		t.Errorf("GET with origin * and credentials: Access-Control-Allow-Origin = %#v; want %#v", got, want)
+	}
+
+	q, err := NewQueryCollectionFS(fstest.MapFS{
+		"persons/get/all_persons.sql": {Data: []byte("response.results = [];")},
+		"persons/pj.json":             {Data: []byte(`{"cors": {"allow_origins": ["*"], "allow_credentials": true}}`)},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+	if err = q.RegisterHTTPHandlers(testMux{}, db, 0); err == nil {
+		t.Errorf("RegisterHTTPHandlers() with origin * and credentials must return error")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	p := New(nil, map[string]string{"GET": "pj__all_persons__get"}, nil)
+
+	r := httptest.NewRequest("DELETE", "/persons", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if got, want := w.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("DELETE status = %v; want %v", got, want)
+	}
+
+	if got, want := w.Header().Get("Allow"), "GET, HEAD, OPTIONS"; got != want {
+		t.Errorf("DELETE Allow = %#v; want %#v", got, want)
+	}
+
+	if got, want := w.Header().Get("Content-Type"), "application/problem+json; charset=utf-8"; got != want {
+		t.Errorf("DELETE Content-Type = %#v; want %#v", got, want)
+	}
+
+	var prob Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &prob); err != nil {
+		t.Fatalf("DELETE body is no valid json: %s", err)
+	}
+
+	if got, want := prob.Code, ErrMethodNotAllowed; got != want {
+		t.Errorf("DELETE problem code = %#v; want %#v", got, want)
+	}
+
+	if got, want := prob.Status, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("DELETE problem status = %v; want %v", got, want)
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	p := New(nil, map[string]string{"POST": "pj__add_person__post", "PUT": "pj__upload__put"}, nil)
+	p.MaxBodySize = 8
+	p.Endpoints = map[string]*Endpoint{"PUT": {MaxBodySize: 64}}
+
+	tests := []struct {
+		method        string
+		body          string
+		contentLength int64
+		expected      int
+	}{
+		{"POST", `{"name": "peter pan"}`, -1, http.StatusRequestEntityTooLarge},
+		{"POST", `{"name": "peter pan"}`, 21, http.StatusRequestEntityTooLarge},
+		{"POST", `{"a": 1`, -1, http.StatusBadRequest},
+		{"PUT", `{"name": "peter pan"`, -1, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/persons", strings.NewReader(test.body))
+		r.ContentLength = test.contentLength
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+
+		if got, want := w.Code, test.expected; got != want {
+			t.Errorf("%s %#v status = %v; want %v", test.method, test.body, got, want)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	p := New(nil, map[string]string{"POST": "pj__add_person__post"}, nil)
+
+	tests := []struct {
+		contentType string
+		body        string
+		expected    string
+		code        string
+	}{
+		{"", `{"name":"peter"}`, `{"name":"peter"}`, ""},
+		{"application/json; charset=utf-8", `{"name":"peter"}`, `{"name":"peter"}`, ""},
+		{"application/x-www-form-urlencoded", `name=peter&tag=a&tag=b`, `{"name":["peter"],"tag":["a","b"]}`, ""},
+		{"multipart/form-data; boundary=xx", "--xx\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\npeter\r\n--xx\r\nContent-Disposition: form-data; name=\"img\"; filename=\"a.txt\"\r\nContent-Type: text/plain\r\n\r\nhi\r\n--xx--\r\n",
+			`{"img":[{"filename":"a.txt","content_type":"text/plain","size":2,"data_base64":"aGk="}],"name":["peter"]}`, ""},
+		{"text/plain", `name`, "", ErrUnsupportedMediaType},
+		{"multipart/form-data", `name`, "", ErrInvalidForm},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/persons", strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+
+		b, err := p.params(r, "POST")
+
+		var code string
+		if prob, ok := err.(*Problem); ok {
+			code = prob.Code
+		}
+
+		if got, want := code, test.code; got != want {
+			t.Errorf("params(%#v, %#v) error code = %#v; want %#v", test.contentType, test.body, got, want)
+		}
+
+		if got, want := string(b), test.expected; got != want {
+			t.Errorf("params(%#v, %#v) = %#v; want %#v", test.contentType, test.body, got, want)
+		}
+	}
+}
+
+func TestMergeParams(t *testing.T) {
+	p := New(nil, map[string]string{"GET": "pj__person__get", "POST": "pj__add_person__post", "DELETE": "pj__delete_person__delete"}, nil)
+	p.PathParams = func(r *http.Request) map[string]string {
+		return map[string]string{"id": "42"}
+	}
+	p.Endpoints = map[string]*Endpoint{"POST": {ParamPrecedence: []string{ParamsQuery, ParamsBody}}}
+
+	tests := []struct {
+		method   string
+		url      string
+		body     string
+		expected string
+	}{
+		{"GET", "/persons?name=peter", "", `{"id":"42","name":["peter"]}`},
+		{"DELETE", "/persons?force=1", "", `{"force":["1"],"id":"42"}`},
+		{"DELETE", "/persons?id=1", `{"reason":"dup"}`, `{"id":"42","reason":"dup"}`},
+		{"POST", "/persons?name=peter", `{"name":"paul","id":1}`, `{"id":1,"name":["peter"]}`},
+		{"POST", "/persons?name=peter", `["paul"]`, `["paul"]`},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		b, err := p.params(r, test.method)
+		if err != nil {
+			t.Errorf("%s %s params() returned error: %s", test.method, test.url, err)
+			continue
+		}
+
+		if got, want := string(b), test.expected; got != want {
+			t.Errorf("%s %s %#v params() = %#v; want %#v", test.method, test.url, test.body, got, want)
+		}
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT pj__json__get($1)":    testResult(`{"results":[1]}`),
+		"SELECT pj__csv__get($1)":     testResult(`{"http_headers":{"Content-Type":"text/csv"},"http_body":"a,b\n1,2\n"}`),
+		"SELECT pj__binary__get($1)":  testResult(`{"http_body_base64":"iVBORw0KGgo="}`),
+		"SELECT pj__invalid__get($1)": testResult(`{"http_body_base64":"!"}`),
+	})
+
+	tests := []struct {
+		fn          string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"pj__json__get", 200, "application/json; charset=utf-8", `{"results":[1]}`},
+		{"pj__csv__get", 200, "text/csv", "a,b\n1,2\n"},
+		{"pj__binary__get", 200, "image/png", "\x89PNG\r\n\x1a\n"},
+		{"pj__invalid__get", 500, "application/problem+json; charset=utf-8", ""},
+	}
+
+	for _, test := range tests {
+		p := New(db, map[string]string{"GET": test.fn}, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+		if got, want := w.Code, test.status; got != want {
+			t.Errorf("%s status = %v; want %v", test.fn, got, want)
+		}
+
+		if got, want := w.Header().Get("Content-Type"), test.contentType; got != want {
+			t.Errorf("%s Content-Type = %#v; want %#v", test.fn, got, want)
+		}
+
+		if got, want := w.Body.String(), test.body; test.body != "" && got != want {
+			t.Errorf("%s body = %#v; want %#v", test.fn, got, want)
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT pj__headers__get($1)":   testResult(`{"http_headers":{"Link":["</a>; rel=next","</b>; rel=last"],"X-Count":3}}`),
+		"SELECT pj__cookies__post($1)":  testResult(`{"http_cookies":[{"name":"a","value":"SECRET","http_only":true,"same_site":"strict"},{"name":"b","value":"2","path":"/x"}],"results":[1]}`),
+		"SELECT pj__redirect__post($1)": testResult(`{"http_redirect":"/persons/42"}`),
+		"SELECT pj__denied__get($1)":    testResult(`{"http_headers":{"strict-transport-security":"max-age=0"}}`),
+	})
+
+	p := New(db, map[string]string{"GET": "pj__headers__get", "POST": "pj__cookies__post"}, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+	if got, want := strings.Join(w.Header()["Link"], ","), "</a>; rel=next,</b>; rel=last"; got != want {
+		t.Errorf("Link headers = %#v; want %#v", got, want)
+	}
+
+	if got, want := w.Header().Get("X-Count"), "3"; got != want {
+		t.Errorf("X-Count header = %#v; want %#v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/x", strings.NewReader("{}")))
+
+	if got, want := strings.Join(w.Header()["Set-Cookie"], ","), "a=SECRET; HttpOnly; SameSite=Strict,b=2; Path=/x"; got != want {
+		t.Errorf("Set-Cookie headers = %#v; want %#v", got, want)
+	}
+
+	if got, want := w.Body.String(), `{"results":[1]}`; got != want {
+		t.Errorf("body with cookies = %#v; want %#v", got, want)
+	}
+
+	p = New(db, map[string]string{"GET": "pj__denied__get", "POST": "pj__redirect__post"}, nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/x", strings.NewReader("{}")))
+
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Errorf("redirect status = %v; want %v", got, want)
+	}
+
+	if got, want := w.Header().Get("Location"), "/persons/42"; got != want {
+		t.Errorf("redirect Location = %#v; want %#v", got, want)
+	}
+
+	if strings.Contains(w.Body.String(), "http_redirect") {
+		t.Errorf("redirect body must not contain http_redirect: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+	if got, want := w.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("denied header status = %v; want %v", got, want)
+	}
+}
+
+func TestParseStatusCode(t *testing.T) {
+
+	tests := []struct {
+		input interface{}
+		valid bool
+	}{
+		{float64(200), true},
+		{float64(599), true},
+		{float64(0), false},
+		{float64(42.7), false},
+		{float64(999), false},
+		{"200", false},
+	}
+
+	for _, test := range tests {
+		if _, err := parseStatusCode(test.input); (err == nil) != test.valid {
+			t.Errorf("parseStatusCode(%#v) error = %v; want valid: %v", test.input, err, test.valid)
+		}
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		hardened bool
+		valid    bool
+	}{
+		{"X-Total-Count", false, true},
+		{"X-Evil\r\nSet-Cookie", false, false},
+		{"X Space", false, false},
+		{"", false, false},
+		{"Content-Security-Policy", false, false},
+		{"Transfer-Encoding", false, true},
+		{"Transfer-Encoding", true, false},
+		{"content-length", true, false},
+	}
+
+	for _, test := range tests {
+		p := &PJ{Hardened: test.hardened}
+		if err := p.checkHeader(test.name); (err == nil) != test.valid {
+			t.Errorf("checkHeader(%#v) hardened: %v error = %v; want valid: %v", test.name, test.hardened, err, test.valid)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	var params string
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT pj__list__get($1)": func(args []driver.Value) ([]byte, error) {
+			params = args[0].(string)
+			return []byte(`{"results":[1,2],"total":5}`), nil
+		},
+		"SELECT pj__cursor__get($1)": testResult(`{"results":[1,2],"next_cursor":"abc"}`),
+	})
+
+	p := New(db, map[string]string{"GET": "pj__list__get"}, nil)
+	p.Endpoints = map[string]*Endpoint{"GET": {Pagination: &Pagination{MaxLimit: 10}}}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x?limit=2&offset=2&q=a", nil))
+
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %v; want %v", got, want)
+	}
+
+	var got map[string]interface{}
+	json.Unmarshal([]byte(params), &got)
+	if page, _ := json.Marshal(got["page"]); string(page) != `{"limit":2,"offset":2}` {
+		t.Errorf("page = %s; want %s", page, `{"limit":2,"offset":2}`)
+	}
+
+	if got, want := w.Header().Get("Link"), `</x?limit=2&q=a>; rel="first", </x?limit=2&offset=0&q=a>; rel="prev", `+
+		`</x?limit=2&offset=4&q=a>; rel="next", </x?limit=2&offset=4&q=a>; rel="last"`; got != want {
+		t.Errorf("Link = %#v; want %#v", got, want)
+	}
+
+	if got, want := w.Header().Get("X-Total-Count"), "5"; got != want {
+		t.Errorf("X-Total-Count = %#v; want %#v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x?limit=11", nil))
+
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Errorf("limit too large status = %v; want %v", got, want)
+	}
+
+	p = New(db, map[string]string{"GET": "pj__cursor__get"}, nil)
+	p.Endpoints = map[string]*Endpoint{"GET": {Pagination: &Pagination{Cursor: true}}}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x?cursor=xyz", nil))
+
+	if got, want := w.Header().Get("Link"), `</x?limit=20>; rel="first", </x?cursor=abc&limit=20>; rel="next"`; got != want {
+		t.Errorf("cursor Link = %#v; want %#v", got, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var (
+		block   = make(chan struct{})
+		started = make(chan struct{})
+	)
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT pj__rated__get($1)":  testResult(`{"result":1}`),
+		"SELECT pj__rated__post($1)": testResult(`{"result":1}`),
+		"SELECT pj__slow__get($1)": func(args []driver.Value) ([]byte, error) {
+			started <- struct{}{}
+			<-block
+			return []byte(`{"result":1}`), nil
+		},
+	})
+
+	p := New(db, map[string]string{"GET": "pj__rated__get"}, nil)
+	p.Limits = &Limits{Rate: 0.1, Burst: 1}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Errorf("first request status = %v; want %v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+	if got, want := w.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("rate limited status = %v; want %v", got, want)
+	}
+
+	if got, want := w.Header().Get("Retry-After"), "10"; got != want {
+		t.Errorf("rate limited Retry-After = %#v; want %#v", got, want)
+	}
+
+	// the body of a rate limited request is not read
+	p.Map["POST"] = "pj__rated__post"
+	for i, code := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		body := &readCounter{r: strings.NewReader("{}")}
+		w = httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("POST", "/x", body))
+
+		if got, want := w.Code, code; got != want {
+			t.Errorf("POST %d status = %v; want %v", i, got, want)
+		}
+		if code == http.StatusTooManyRequests && body.n > 0 {
+			t.Errorf("body of a rate limited request must not be read")
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Errorf("other client status = %v; want %v", got, want)
+	}
+
+	var maxInFlight int
+	p = New(db, map[string]string{"GET": "pj__slow__get"}, nil)
+	p.Endpoints = map[string]*Endpoint{"GET": {Limits: &Limits{MaxInFlight: 1}}}
+	p.QueueObserver = func(r *http.Request, inFlight, queued int) {
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+	}
+
+	p.Map["POST"] = "pj__slow__post"
+	p.MaxBodySize = 8
+	p.Limits = &Limits{MaxInFlight: 1}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/x", nil))
+
+	if got, want := w.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("max in flight status = %v; want %v", got, want)
+	}
+
+	// the body is limited before the request waits for a call
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/x", strings.NewReader(`{"name":"too large"}`)))
+
+	if got, want := w.Code, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("max in flight status with too large body = %v; want %v", got, want)
+	}
+
+	close(block)
+	if got, want := <-done, http.StatusOK; got != want {
+		t.Errorf("in flight request status = %v; want %v", got, want)
+	}
+
+	if got, want := maxInFlight, 1; got != want {
+		t.Errorf("observed in flight = %v; want %v", got, want)
+	}
+}
+
+// readCounter is a reader that counts the read bytes
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestLimiterBuckets(t *testing.T) {
+	li := newLimiter(Limits{Rate: 0.001, Burst: 1})
+	now := time.Now()
+
+	li.allow("a", now)
+	li.allow("b", now)
+	for i := 0; i < maxBuckets; i++ {
+		li.allow("a", now)
+		li.allow(strconv.Itoa(i), now)
+	}
+
+	if got, want := len(li.buckets), maxBuckets; got != want {
+		t.Errorf("number of buckets = %v; want %v", got, want)
+	}
+
+	if _, has := li.buckets["b"]; has {
+		t.Errorf("bucket of the least recently seen client must be removed")
+	}
+
+	if ok, _ := li.allow("a", now); ok {
+		t.Errorf("bucket of a recently seen client must be kept")
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	li := newLimiter(Limits{MaxInFlight: 1, MaxQueue: 2})
+	release, err := li.acquire(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("acquire() returned error: %s", err)
+	}
+
+	var (
+		mu        sync.Mutex
+		maxQueued int
+		wg        sync.WaitGroup
+	)
+	observe := func(inFlight, queued int) {
+		mu.Lock()
+		if queued > maxQueued {
+			maxQueued = queued
+		}
+		mu.Unlock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := li.acquire(ctx, observe)
+			errs <- err
+		}()
+	}
+
+	full := 0
+wait:
+	for i := 0; i < 18; i++ {
+		select {
+		case err := <-errs:
+			if err == errQueueFull {
+				full++
+			}
+		case <-time.After(time.Second):
+			break wait
+		}
+	}
+	cancel()
+	wg.Wait()
+	release()
+
+	if got, want := full, 18; got != want {
+		t.Errorf("requests rejected with full queue = %v; want %v", got, want)
+	}
+	if got, want := maxQueued, 2; got != want {
+		t.Errorf("max queued = %v; want %v", got, want)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	fsys := fstest.MapFS{
+		"persons/get/all_persons.sql": {Data: []byte("response.results = [];")},
+		"persons/post/add_person.sql": {Data: []byte("response.results = [params];")},
+		"persons/pj.json":             {Data: []byte(`{"endpoints": {"get": {"signature": {"returns": "json"}}}}`)},
+	}
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+	q.Signature = Signature{Params: "jsonb"}
+
+	stmts, err := q.RegisterQueryFuncs(nil, true)
+	if err != nil {
+		t.Fatalf("RegisterQueryFuncs(nil, true) returned error: %s", err)
+	}
+
+	for _, stmt := range stmts {
+		switch {
+		case strings.Contains(stmt, "pj__all_persons__get(params jsonb) RETURNS json AS"):
+			if !strings.Contains(stmt, "return response;") {
+				t.Errorf("function returning json must return the response object: %s", stmt)
+			}
+		case strings.Contains(stmt, "pj__add_person__post(params jsonb) RETURNS jsonb AS"):
+			t.Errorf("unexpected return type: %s", stmt)
+		case strings.Contains(stmt, "pj__add_person__post(params jsonb) RETURNS text AS"):
+			if !strings.Contains(stmt, "return JSON.stringify(response);") {
+				t.Errorf("function returning text must stringify the response: %s", stmt)
+			}
+		default:
+			t.Errorf("unexpected statement %#v", stmt)
+		}
+	}
+
+	fsys["persons/pj.json"] = &fstest.MapFile{Data: []byte(`{"endpoints": {"GET": {"signature": {"returns": "xml"}}}}`)}
+	if _, err = q.RegisterQueryFuncs(nil, true); err == nil {
+		t.Errorf("RegisterQueryFuncs() with invalid signature must return error")
+	}
+}
+
+// lockedMux is a Muxer for the tests that may be used while it is serving
+type lockedMux struct {
+	sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+func (m *lockedMux) Handle(path string, h http.Handler) {
+	m.Lock()
+	m.handlers[path] = h
+	m.Unlock()
+}
+
+func (m *lockedMux) RemoveHandler(path string) {
+	m.Lock()
+	delete(m.handlers, path)
+	m.Unlock()
+}
+
+func (m *lockedMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.RLock()
+	h, has := m.handlers[strings.Trim(r.URL.Path, "/")]
+	m.RUnlock()
+	if !has {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func TestUpdateWhileServing(t *testing.T) {
+	fsys := fstest.MapFS{
+		"persons/get/all_persons.sql": {Data: []byte(`response.results = [];`)},
+	}
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT pj__all_persons__get($1)": testResult(`{"results":[]}`),
+	})
+
+	q, err := NewQueryCollectionFS(fsys, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionFS() returned error: %s", err)
+	}
+
+	mux := &lockedMux{handlers: map[string]http.Handler{}}
+	err = q.RegisterHTTPHandlers(mux, db, 0)
+	if err != nil {
+		t.Fatalf("RegisterHTTPHandlers() returned error: %s", err)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, meth := range []string{"GET", "OPTIONS"} {
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, httptest.NewRequest(meth, "/persons", nil))
+				if rec.Code >= 400 {
+					t.Errorf("%s /persons returned status %d", meth, rec.Code)
+					return
+				}
+			}
+		}
+	}()
+
+	edb := &execDB{}
+	for i := 0; i < 20; i++ {
+		fsys["persons/post/add_person.sql"] = &fstest.MapFile{Data: []byte(`response.results = [params];`)}
+		fsys["persons/pj.json"] = &fstest.MapFile{Data: []byte(`{"max_body_size": 4096}`)}
+		steps := []error{
+			q.AddQuery(mux, edb, "persons/post/add_person.sql"),
+			q.UpdateQuery(mux, edb, "persons/get/all_persons.sql"),
+			q.RemoveQuery(mux, edb, "persons/post/add_person.sql"),
+			q.UpdateMountConfig(mux, "persons"),
+		}
+		for _, err := range steps {
+			if err != nil {
+				t.Fatalf("updating the query functions returned error: %s", err)
+			}
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2015 Marc René Arns. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+/*
+Package pjpgx provides a pj.Backend that calls the query functions directly via a pgx connection pool
+instead of database/sql.
+
+For each query function a statement is prepared on first use and reused on all connections of the pool,
+including connections that are opened later. The QueryCollection invalidates it, if the function changes.
+The params and the results are transferred in the binary format, json and jsonb are passed through as []byte
+without being re-encoded.
+
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: conf})
+	...
+	qc.Backend = pjpgx.New(pool)
+	err = qc.RegisterHTTPHandlers(mux, db, 2048)
+*/
+package pjpgx
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-on/pj"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+)
+
+// jsonbVersion is the version of the binary format of jsonb
+const jsonbVersion = 1
+
+// Backend is a pj.Backend that uses a pgx connection pool
+type Backend struct {
+	pool *pgx.ConnPool
+
+	mu    sync.RWMutex
+	stmts map[string]*pgx.PreparedStatement
+}
+
+var (
+	_ pj.Backend   = &Backend{}
+	_ pj.StmtCache = &Backend{}
+	_ pj.Pinger    = &Backend{}
+)
+
+// New returns a Backend that calls the query functions via the given pool
+func New(pool *pgx.ConnPool) *Backend {
+	return &Backend{pool: pool, stmts: map[string]*pgx.PreparedStatement{}}
+}
+
+// prepare returns the prepared statement for the query function fn, preparing it, if needed
+func (b *Backend) prepare(ctx context.Context, fn string) (*pgx.PreparedStatement, error) {
+	b.mu.RLock()
+	ps, has := b.stmts[fn]
+	b.mu.RUnlock()
+	if has {
+		return ps, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ps, has = b.stmts[fn]; has {
+		return ps, nil
+	}
+
+	ps, err := b.pool.PrepareEx(ctx, fn, "SELECT "+fn+"($1)", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ps.ParameterOIDs) != 1 || len(ps.FieldDescriptions) != 1 {
+		return nil, errors.New("query function " + fn + " must have one parameter and one result")
+	}
+
+	b.stmts[fn] = ps
+	return ps, nil
+}
+
+// Call calls the query function fn with the json params
+func (b *Backend) Call(ctx context.Context, fn string, params []byte) ([]byte, error) {
+	ps, err := b.prepare(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &result{jsonb: ps.FieldDescriptions[0].DataType == pgtype.JSONBOID}
+	arg := param{b: params, jsonb: ps.ParameterOIDs[0] == pgtype.JSONBOID}
+
+	err = b.pool.QueryRowEx(ctx, fn, nil, arg).Scan(res)
+	if err != nil {
+		if b.invalidated(fn, ps) {
+			// the statement has been invalidated while it was used, try again with a new one
+			return b.Call(ctx, fn, params)
+		}
+		return nil, err
+	}
+	return res.b, nil
+}
+
+// invalidated reports whether ps is no longer the prepared statement of the query function fn
+func (b *Backend) invalidated(fn string, ps *pgx.PreparedStatement) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.stmts[fn] != ps
+}
+
+// Invalidate deallocates the prepared statement of the query function fn on all connections of the pool
+func (b *Backend) Invalidate(fn string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, has := b.stmts[fn]; has {
+		delete(b.stmts, fn)
+		b.pool.Deallocate(fn)
+	}
+}
+
+// Ping checks the connection to the database
+func (b *Backend) Ping(ctx context.Context) error {
+	var one int32
+	return b.pool.QueryRowEx(ctx, "SELECT 1", nil).Scan(&one)
+}
+
+// Listen listens on the postgres channel, e.g. pj.RegistryChannel, with a connection of the pool
+// and calls fn with the payload of each notification. fn is called once after the listening started,
+// so that no change is missed between the loading of the endpoints and the listening.
+// Listen blocks until ctx is done or the connection fails.
+//
+//	go b.Listen(ctx, pj.RegistryChannel, func(string) {
+//		if err := qc.Reload(mux, db); err != nil {
+//			log.Println(err)
+//		}
+//	})
+func (b *Backend) Listen(ctx context.Context, channel string, fn func(payload string)) error {
+	conn, err := b.pool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer b.pool.Release(conn)
+
+	err = conn.Listen(channel)
+	if err != nil {
+		return err
+	}
+	defer conn.Unlisten(channel)
+
+	fn("")
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		fn(n.Payload)
+	}
+}
+
+// param is the json params in the binary format of json or jsonb
+type param struct {
+	b     []byte
+	jsonb bool
+}
+
+// EncodeBinary implements pgtype.BinaryEncoder
+func (p param) EncodeBinary(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	if p.jsonb {
+		buf = append(buf, jsonbVersion)
+	}
+	return append(buf, p.b...), nil
+}
+
+var _ pgtype.BinaryEncoder = param{}
+
+// result is the result of a query function, a text, json or jsonb value
+type result struct {
+	b     []byte
+	jsonb bool
+}
+
+// DecodeBinary implements pgtype.BinaryDecoder
+func (r *result) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		r.b = nil
+		return nil
+	}
+
+	if r.jsonb {
+		if len(src) == 0 || src[0] != jsonbVersion {
+			return errors.New("unknown jsonb version")
+		}
+		src = src[1:]
+	}
+
+	// src is only valid until the next row is read
+	r.b = append(make([]byte, 0, len(src)), src...)
+	return nil
+}
+
+// DecodeText implements pgtype.TextDecoder
+func (r *result) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		r.b = nil
+		return nil
+	}
+	r.b = append(make([]byte, 0, len(src)), src...)
+	return nil
+}
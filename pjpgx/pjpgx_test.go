@@ -0,0 +1,103 @@
+package pjpgx
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-on/pj"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+)
+
+func TestParamResult(t *testing.T) {
+	b, _ := param{b: []byte(`{}`), jsonb: true}.EncodeBinary(nil, nil)
+	if got, want := string(b), "\x01{}"; got != want {
+		t.Errorf("jsonb param = %q; want %q", got, want)
+	}
+
+	var r result
+	r.jsonb = true
+	if err := r.DecodeBinary(nil, []byte("\x01{}")); err != nil || string(r.b) != "{}" {
+		t.Errorf("jsonb result = %q, %v; want %q", r.b, err, "{}")
+	}
+
+	if err := r.DecodeBinary(nil, []byte("{}")); err == nil {
+		t.Errorf("jsonb result without version must return error")
+	}
+
+	r.jsonb = false
+	if err := r.DecodeBinary(nil, nil); err != nil || r.b != nil {
+		t.Errorf("NULL result = %q, %v; want nil", r.b, err)
+	}
+}
+
+// The benchmarks need a postgresql database, given by the environment variable PG_URL.
+// They are skipped, if it is not set.
+
+const benchFunc = "pj__bench__get"
+
+func benchPool(b *testing.B) (*pgx.ConnPool, pgx.ConnConfig) {
+	url := os.Getenv("PG_URL")
+	if url == "" {
+		b.Skip("PG_URL not set")
+	}
+
+	conf, err := pgx.ParseURI(url)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: conf})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	_, err = pool.Exec(`CREATE OR REPLACE FUNCTION ` + benchFunc + `(params json) RETURNS text AS $function$
+		SELECT json_build_object('result', params)::text
+	$function$ LANGUAGE sql IMMUTABLE STRICT`)
+	if err != nil {
+		pool.Close()
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		pool.Exec(`DROP FUNCTION IF EXISTS ` + benchFunc + `(json)`)
+		pool.Close()
+	})
+	return pool, conf
+}
+
+func benchCall(b *testing.B, backend pj.Backend) {
+	params := []byte(`{"name":"peter","tags":["a","b"]}`)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			res, err := backend.Call(ctx, benchFunc, params)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if len(res) == 0 {
+				b.Error("empty result")
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkBackend(b *testing.B) {
+	pool, _ := benchPool(b)
+	benchCall(b, New(pool))
+}
+
+func BenchmarkSQLDB(b *testing.B) {
+	_, conf := benchPool(b)
+	db := stdlib.OpenDB(conf)
+	defer db.Close()
+	benchCall(b, pj.NewQueryerBackend(db))
+}
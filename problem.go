@@ -0,0 +1,88 @@
+package pj
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The stable error codes of the problem documents that PJ responds with
+const (
+	ErrMethodNotAllowed     = "method_not_allowed"     // no query function for the request method
+	ErrBadRequest           = "bad_request"            // the request body could not be read
+	ErrBodyTooLarge         = "body_too_large"         // the request body exceeds the MaxBodySize
+	ErrInvalidJSON          = "invalid_json"           // the request body is no valid json
+	ErrInvalidForm          = "invalid_form"           // the form encoded or multipart request body is invalid
+	ErrUnsupportedMediaType = "unsupported_media_type" // the content type of the request body is not supported
+	ErrInvalidParams        = "invalid_params"         // the query function returned NULL, e.g. because the params are no json object
+	ErrScan                 = "scan_error"             // the result of the query function could not be scanned
+	ErrQueryFailed          = "query_failed"           // the query function failed with a database error
+	ErrDatabaseUnavailable  = "database_unavailable"   // the database is not available, see RetryPolicy
+	ErrUniqueViolation      = "unique_violation"       // the query function violated a unique constraint (SQLSTATE 23505)
+	ErrForeignKeyViolation  = "foreign_key_violation"  // the query function violated a foreign key constraint (SQLSTATE 23503)
+	ErrConstraintViolation  = "constraint_violation"   // the query function violated another constraint (SQLSTATE class 23)
+	ErrForbidden            = "forbidden"              // the database role lacks a privilege (SQLSTATE 42501)
+	ErrNotFound             = "not_found"              // the query function raised no_data_found (SQLSTATE P0002)
+	ErrRaised               = "raised"                 // the query function raised an error with an http status (SQLSTATE PJ400 - PJ599)
+	ErrInvalidResponse      = "invalid_response"       // the query function returned no valid json object
+	ErrInvalidStatusCode    = "invalid_status_code"    // the http_status_code of the result is invalid
+	ErrInvalidHeaders       = "invalid_headers"        // the http_headers of the result are invalid
+	ErrInvalidBody          = "invalid_body"           // the http_body or http_body_base64 of the result is invalid
+	ErrInvalidCookies       = "invalid_cookies"        // the http_cookies of the result are invalid
+	ErrInvalidRedirect      = "invalid_redirect"       // the http_redirect of the result is invalid
+	ErrInvalidPagination    = "invalid_pagination"     // the requested limit, offset or cursor is invalid
+	ErrTooManyRequests      = "too_many_requests"      // the request exceeds the Limits of the endpoint
+)
+
+// Problem is a problem document as described by RFC 7807 that is sent to the client if a request fails.
+type Problem struct {
+	Type   string `json:"type,omitempty"` // omitted means about:blank
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"` // one of the Err* constants
+
+	// the fields of database errors, see PJ.ExposeDBError
+	SQLState   string `json:"sqlstate,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+
+	Err     error `json:"-"` // the underlying error
+	Retries int   `json:"-"` // the number of retries of the call of the query function, see RetryPolicy
+}
+
+func (p *Problem) Error() string {
+	msg := p.Code
+	if p.Err != nil {
+		msg += ": " + p.Err.Error()
+	}
+	if p.Retries > 0 {
+		msg += " (after " + strconv.Itoa(p.Retries) + " retries)"
+	}
+	return msg
+}
+
+// newProblem returns the Problem for the given status, error code and underlying error.
+// The message of the error is only exposed as detail for client errors.
+func newProblem(status int, code string, err error) *Problem {
+	p := &Problem{Title: http.StatusText(status), Status: status, Code: code, Err: err}
+	if err != nil && status < 500 {
+		p.Detail = err.Error()
+	}
+	return p
+}
+
+// RenderProblem is the default error renderer of PJ. It writes the problem as json with the
+// content type application/problem+json.
+func RenderProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		w.WriteHeader(p.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+	w.WriteHeader(p.Status)
+	if r.Method != "HEAD" {
+		w.Write(b)
+	}
+}
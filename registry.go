@@ -0,0 +1,188 @@
+package pj
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The sources of the endpoints of a QueryCollection that is created by NewQueryCollectionDB.
+// The functions are deployed by other means, e.g. migrations.
+const (
+	// RegistryTable reads the endpoints from the table pj_endpoints, that is expected to look like
+	//
+	//	CREATE TABLE pj_endpoints (
+	//		mount    text NOT NULL, -- the mount path, e.g. api/v1/persons
+	//		method   text NOT NULL, -- the request method, e.g. GET
+	//		function text NOT NULL, -- the name of the postgres function, e.g. persons.all
+	//		PRIMARY KEY (mount, method)
+	//	);
+	RegistryTable = "table"
+
+	// RegistryNaming discovers the postgres functions whose names follow the convention
+	// pj_api__[mount]__[method], where the segments of the mount path are separated by a double underscore,
+	// e.g. pj_api__api__v1__persons__get serves GET /api/v1/persons
+	RegistryNaming = "naming"
+
+	// RegistryComment discovers the postgres functions that have a comment of the form
+	// pj: [METHOD] [mount], e.g.
+	//
+	//	COMMENT ON FUNCTION all_persons(json) IS 'pj: GET api/v1/persons';
+	RegistryComment = "comment"
+)
+
+// RegistryChannel is the channel that is notified, if the endpoints in the database change, e.g. via
+//
+//	NOTIFY pj_endpoints_changed;
+//
+// The notifications should trigger QueryCollection.Reload, see the Listen method of github.com/go-on/pj/pjpgx.
+const RegistryChannel = "pj_endpoints_changed"
+
+// registryQueries are the queries that return the endpoints of the registry sources
+// as json array of [mount, method, function] arrays
+var registryQueries = map[string]string{
+	RegistryTable: `SELECT coalesce(json_agg(json_build_array(mount, upper(method), function)), '[]')::text FROM pj_endpoints`,
+
+	RegistryNaming: `SELECT coalesce(json_agg(json_build_array(
+		replace(substring(proname from '^pj_api__(.+)__[a-z]+$'), '__', '/'),
+		upper(substring(proname from '__([a-z]+)$')),
+		p.oid::regproc::text
+	)), '[]')::text FROM pg_proc p WHERE proname LIKE 'pj\_api\_\_%'`,
+
+	RegistryComment: `SELECT coalesce(json_agg(json_build_array(
+		split_part(btrim(substring(d.description from 4)), ' ', 2),
+		upper(split_part(btrim(substring(d.description from 4)), ' ', 1)),
+		p.oid::regproc::text
+	)), '[]')::text FROM pg_proc p JOIN pg_description d ON d.objoid = p.oid AND d.classoid = 'pg_proc'::regclass
+	WHERE d.description LIKE 'pj:%'`,
+}
+
+// validFuncName matches the names of postgres functions that may be called by the http handlers,
+// optionally qualified by a schema
+var validFuncName = regexp.MustCompile(`^[a-z_][a-z_0-9$]*(\.[a-z_][a-z_0-9$]*)?$`)
+
+var errNoFiles = errors.New("query collection has no query function files, it reads the endpoints from the database")
+
+// checkMount returns an error, if mntp is not a valid mount path
+func checkMount(mntp string) error {
+	for _, seg := range strings.Split(mntp, "/") {
+		if !validName.MatchString(seg) {
+			return errors.New("invalid mount path /" + mntp + ": invalid segment " + seg)
+		}
+	}
+	return nil
+}
+
+// readRegistry reads the endpoints of the registry source from the db. It returns the map of mount paths
+// to the map of request methods to postgres function names.
+func readRegistry(db Queryer, source string) (map[string]map[string]string, error) {
+	query, has := registryQueries[source]
+	if !has {
+		return nil, errors.New("unknown registry " + source + ", must be table, naming or comment")
+	}
+
+	var b []byte
+	err := db.QueryRow(query).Scan(&b)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][3]string
+	err = json.Unmarshal(b, &rows)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := map[string]map[string]string{}
+	for _, row := range rows {
+		mntp, meth, fn := strings.Trim(row[0], "/"), row[1], row[2]
+
+		if err = checkMount(mntp); err != nil {
+			return nil, errors.New("function " + fn + ": " + err.Error())
+		}
+
+		switch meth {
+		case "GET", "POST", "PUT", "PATCH", "DELETE":
+		default:
+			return nil, errors.New("function " + fn + ": method " + meth + " is not allowed")
+		}
+
+		if !validFuncName.MatchString(fn) {
+			return nil, errors.New("invalid function name " + fn + " for " + meth + " /" + mntp)
+		}
+
+		if _, has := queries[mntp]; !has {
+			queries[mntp] = map[string]string{}
+		}
+
+		if other, has := queries[mntp][meth]; has {
+			return nil, errors.New("more than one function for " + meth + " /" + mntp + ": " + other + " and " + fn)
+		}
+		queries[mntp][meth] = fn
+	}
+	return queries, nil
+}
+
+// NewQueryCollectionDB creates a QueryCollection that reads its endpoints from the db instead of query function files.
+// source is one of RegistryTable, RegistryNaming and RegistryComment.
+// The Queries of the QueryCollection map the mount paths to the map of request methods to the postgres function names.
+// Since there are no query function files, the methods that deploy, compare or drop them return an error
+// and the handlers have no MountConfig.
+func NewQueryCollectionDB(db Queryer, source string, errTracker func(error, *http.Request)) (*QueryCollection, error) {
+	queries, err := readRegistry(db, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryCollection{
+		Queries:     queries,
+		Handlers:    map[string]*PJ{},
+		errTracker:  errTracker,
+		Mutex:       &sync.Mutex{},
+		registry:    source,
+		maxBodySize: 2048,
+	}, nil
+}
+
+// Reload rereads the endpoints from the db and updates the http handlers: handlers of new mount paths are
+// registered, handlers of removed mount paths are removed and the handlers of the other mount paths are
+// replaced by new ones for the current functions, so that Reload may be called while the handlers are serving.
+// The prepared statements of all functions are invalidated, since they may have been replaced.
+// It must only be called for a QueryCollection that has been created by NewQueryCollectionDB.
+func (q *QueryCollection) Reload(mux Muxer, db Queryer) error {
+	if q.registry == "" {
+		return errors.New("query collection does not read the endpoints from the database")
+	}
+
+	queries, err := readRegistry(db, q.registry)
+	if err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	for mntp, m := range q.Queries {
+		for _, fn := range m {
+			q.invalidate(mntp, fn)
+		}
+		if _, has := queries[mntp]; !has {
+			delete(q.Handlers, mntp)
+			mux.RemoveHandler(mntp)
+		}
+	}
+
+	q.Queries = queries
+	for mntp := range queries {
+		pj, err := q.handler(db, mntp)
+		if err != nil {
+			return err
+		}
+		q.Handlers[mntp] = pj
+		mux.Handle(mntp, pj)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package pj
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testMux is a Muxer for the tests
+type testMux map[string]http.Handler
+
+func (m testMux) Handle(path string, h http.Handler) { m[path] = h }
+func (m testMux) RemoveHandler(path string)          { delete(m, path) }
+
+func TestRegistry(t *testing.T) {
+	endpoints := `[["api/v1/persons","GET","persons.all"],["api/v1/persons","POST","persons.add"],["things","GET","all_things"]]`
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		registryQueries[RegistryTable]: func(args []driver.Value) ([]byte, error) { return []byte(endpoints), nil },
+		"SELECT persons.all($1)":       testResult(`{"results":["all"]}`),
+		"SELECT persons.active($1)":    testResult(`{"results":["active"]}`),
+	})
+
+	q, err := NewQueryCollectionDB(db, RegistryTable, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionDB() returned error: %s", err)
+	}
+
+	mux := testMux{}
+	err = q.RegisterHTTPHandlers(mux, db, 0)
+	if err != nil {
+		t.Fatalf("RegisterHTTPHandlers() returned error: %s", err)
+	}
+
+	if len(mux) != 2 || mux["api/v1/persons"] == nil || mux["things"] == nil {
+		t.Fatalf("registered handlers = %v; want api/v1/persons and things", mux)
+	}
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		mux["api/v1/persons"].ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/persons", nil))
+		return rec.Body.String()
+	}
+
+	if got, want := get(), `{"results":["all"]}`; got != want {
+		t.Errorf("GET /api/v1/persons = %#v; want %#v", got, want)
+	}
+
+	if _, err = q.RegisterQueryFuncs(db, false); err != errNoFiles {
+		t.Errorf("RegisterQueryFuncs() returned %v; want %v", err, errNoFiles)
+	}
+
+	endpoints = `[["api/v1/persons","GET","persons.active"]]`
+	err = q.Reload(mux, db)
+	if err != nil {
+		t.Fatalf("Reload() returned error: %s", err)
+	}
+
+	if len(mux) != 1 || mux["things"] != nil {
+		t.Errorf("registered handlers after Reload = %v; want api/v1/persons", mux)
+	}
+
+	if got, want := q.Handlers["api/v1/persons"].allow(), "GET, HEAD, OPTIONS"; got != want {
+		t.Errorf("allowed methods after Reload = %#v; want %#v", got, want)
+	}
+
+	if got, want := get(), `{"results":["active"]}`; got != want {
+		t.Errorf("GET /api/v1/persons after Reload = %#v; want %#v", got, want)
+	}
+
+	invalid := []string{
+		`[["api/V1","GET","persons.all"]]`,
+		`[["persons","HEAD","persons.all"]]`,
+		`[["persons","GET","\"Persons\""]]`,
+		`[["persons","GET","persons.all"],["persons","GET","persons.active"]]`,
+	}
+
+	for _, inv := range invalid {
+		endpoints = inv
+		if err = q.Reload(mux, db); err == nil {
+			t.Errorf("Reload() with endpoints %s must return error", inv)
+		}
+	}
+
+	if _, err = NewQueryCollectionDB(db, "files", nil); err == nil {
+		t.Errorf("NewQueryCollectionDB() with unknown source must return error")
+	}
+}
+
+func TestReloadWhileServing(t *testing.T) {
+	db := testDB(map[string]func(args []driver.Value) ([]byte, error){
+		"SELECT coalesce(json_agg(json_build_array(mount, upper(method), function)), '[]')::text FROM pj_endpoints": testResult(`[["persons","GET","persons.all"]]`),
+		"SELECT persons.all($1)": testResult(`{"results":["all"]}`),
+	})
+
+	q, err := NewQueryCollectionDB(db, RegistryTable, nil)
+	if err != nil {
+		t.Fatalf("NewQueryCollectionDB() returned error: %s", err)
+	}
+
+	mux := &lockedMux{handlers: map[string]http.Handler{}}
+	err = q.RegisterHTTPHandlers(mux, db, 0)
+	if err != nil {
+		t.Fatalf("RegisterHTTPHandlers() returned error: %s", err)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("GET", "/persons", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET /persons returned status %d", rec.Code)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if err = q.Reload(mux, db); err != nil {
+			t.Errorf("Reload() returned error: %s", err)
+			break
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,213 @@
+package pj
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The volatility categories of the postgres functions, see Endpoint.Volatility
+const (
+	Volatile  = "VOLATILE"
+	Stable    = "STABLE"
+	Immutable = "IMMUTABLE"
+)
+
+// DefaultReadYourWritesCookie is the default name of the cookie that pins a client to the primary
+const DefaultReadYourWritesCookie = "pj_primary"
+
+// Replicas are the read replicas of the primary database, i.e. the Backend of a PJ.
+//
+// GET requests and requests to endpoints whose Volatility is Stable or Immutable are load balanced
+// across the healthy replicas, all other requests are served by the primary.
+// If no replica is healthy, the primary serves the request. If a replica fails with a connection error,
+// it is marked as unhealthy and the request is served by the primary.
+//
+// After a request has been served by the primary, the client is pinned to the primary for the
+// ReadYourWrites duration via a cookie, so that it reads its own writes.
+type Replicas struct {
+	// Backends are the Backends of the replicas
+	Backends []Backend
+
+	// ReadYourWrites is the duration a client is pinned to the primary after a successful request
+	// that has been served by the primary. No client is pinned, if it is 0.
+	ReadYourWrites time.Duration
+
+	// Cookie is the name of the cookie that pins a client to the primary, defaults to DefaultReadYourWritesCookie
+	Cookie string
+
+	// HealthInterval is the interval in which the health of the replicas is checked, defaults to 5 seconds.
+	// The checks are triggered by the requests.
+	HealthInterval time.Duration
+
+	// Check checks the health of a replica. If nil, the replica is pinged, if its Backend has a
+	// Ping method (see Pinger), otherwise it is considered healthy.
+	Check func(ctx context.Context, b Backend) error
+
+	mu     sync.Mutex
+	next   int
+	health []replicaHealth
+}
+
+// Pinger is implemented by Backends that can check the connection to their database
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type replicaHealth struct {
+	unhealthy bool
+	checked   time.Time
+	checking  bool
+}
+
+// NewReplicas returns Replicas for the given Queryers of the replicas, e.g. *sql.DBs,
+// with a ReadYourWrites duration of 5 seconds.
+func NewReplicas(replicas ...Queryer) *Replicas {
+	r := &Replicas{ReadYourWrites: 5 * time.Second}
+	for _, q := range replicas {
+		r.Backends = append(r.Backends, NewQueryerBackend(q))
+	}
+	return r
+}
+
+func (rs *Replicas) cookie() string {
+	if rs.Cookie != "" {
+		return rs.Cookie
+	}
+	return DefaultReadYourWritesCookie
+}
+
+func (rs *Replicas) healthInterval() time.Duration {
+	if rs.HealthInterval > 0 {
+		return rs.HealthInterval
+	}
+	return 5 * time.Second
+}
+
+// pick returns the index of the next healthy replica in round robin order, or -1, if there is none.
+// It triggers the health checks that are due.
+func (rs *Replicas) pick(now time.Time) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if len(rs.health) != len(rs.Backends) {
+		rs.health = make([]replicaHealth, len(rs.Backends))
+	}
+
+	for i := range rs.health {
+		h := &rs.health[i]
+		if !h.checking && now.Sub(h.checked) >= rs.healthInterval() {
+			h.checking = true
+			go rs.check(i)
+		}
+	}
+
+	for n := 0; n < len(rs.Backends); n++ {
+		i := (rs.next + n) % len(rs.Backends)
+		if !rs.health[i].unhealthy {
+			rs.next = i + 1
+			return i
+		}
+	}
+	return -1
+}
+
+// check checks the health of the replica i
+func (rs *Replicas) check(i int) {
+	ctx, cancel := context.WithTimeout(context.Background(), rs.healthInterval())
+	defer cancel()
+
+	var err error
+	b := rs.Backends[i]
+	switch {
+	case rs.Check != nil:
+		err = rs.Check(ctx, b)
+	default:
+		if p, ok := b.(Pinger); ok {
+			err = p.Ping(ctx)
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if i < len(rs.health) {
+		rs.health[i] = replicaHealth{unhealthy: err != nil, checked: time.Now()}
+	}
+}
+
+// markUnhealthy marks the replica i as unhealthy until its next health check
+func (rs *Replicas) markUnhealthy(i int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if i < len(rs.health) {
+		rs.health[i].unhealthy = true
+		rs.health[i].checked = time.Now()
+	}
+}
+
+// pinned reports whether the client of the request r is pinned to the primary
+func (rs *Replicas) pinned(r *http.Request, now time.Time) bool {
+	c, err := r.Cookie(rs.cookie())
+	if err != nil {
+		return false
+	}
+	until, err := strconv.ParseInt(c.Value, 10, 64)
+	return err == nil && now.Unix() < until
+}
+
+// pin sets the cookie that pins the client to the primary
+func (rs *Replicas) pin(w http.ResponseWriter, now time.Time) {
+	if rs.ReadYourWrites <= 0 {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     rs.cookie(),
+		Value:    strconv.FormatInt(now.Add(rs.ReadYourWrites).Unix(), 10),
+		Path:     "/",
+		MaxAge:   int((rs.ReadYourWrites + time.Second - 1) / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readOnly reports whether requests for the method meth may be served by a replica
+func (p *PJ) readOnly(meth string) bool {
+	vol := p.endpoint(meth).Volatility
+	if vol == "" {
+		vol = defaultVolatility(meth)
+	}
+	switch strings.ToUpper(vol) {
+	case Stable, Immutable:
+		return true
+	}
+	return false
+}
+
+// callReplica calls the query function fn on a replica, if the request r may be served by one.
+// It returns ok = false, if the request must be served by the primary. Errors are returned as problems.
+func (p *PJ) callReplica(r *http.Request, meth, fn string, params []byte) (result []byte, ok bool, err error) {
+	rs := p.Replicas
+	now := time.Now()
+	if rs == nil || len(rs.Backends) == 0 || !p.readOnly(meth) || rs.pinned(r, now) {
+		return nil, false, nil
+	}
+
+	i := rs.pick(now)
+	if i < 0 {
+		return nil, false, nil
+	}
+
+	result, err = rs.Backends[i].Call(r.Context(), fn, params)
+	if err != nil && dbErrorKind(err) != dbErrQuery && r.Context().Err() == nil {
+		// no error of the query function, but of the replica
+		rs.markUnhealthy(i)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, p.dbProblem(r, err)
+	}
+	return result, true, nil
+}
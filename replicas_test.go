@@ -0,0 +1,82 @@
+package pj
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testBackend is a Backend that returns the name of the backend as result
+type testBackend struct {
+	name string
+	err  error
+}
+
+func (b testBackend) Call(ctx context.Context, fn string, params []byte) ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return []byte(`{"result":"` + b.name + `"}`), nil
+}
+
+func TestReplicas(t *testing.T) {
+	down := testBackend{name: "down", err: errors.New("connection refused")}
+
+	p := New(nil, map[string]string{"GET": "pj__r__get", "POST": "pj__r__post", "PUT": "pj__r__put"}, nil)
+	p.Backend = testBackend{name: "primary"}
+	p.Endpoints = map[string]*Endpoint{"PUT": {Volatility: "stable"}}
+	p.Replicas = &Replicas{
+		Backends:       []Backend{testBackend{name: "r1"}, down, testBackend{name: "r2"}},
+		ReadYourWrites: time.Minute,
+		HealthInterval: time.Hour,
+		Check: func(ctx context.Context, b Backend) error {
+			return b.(testBackend).err
+		},
+	}
+
+	serve := func(meth string, cookie *http.Cookie) (string, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(meth, "/x", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Body.String(), w
+	}
+
+	tests := []struct {
+		meth     string
+		expected string
+	}{
+		{"GET", `{"result":"r1"}`},
+		{"GET", `{"result":"primary"}`}, // down is marked unhealthy
+		{"GET", `{"result":"r2"}`},
+		{"GET", `{"result":"r1"}`},
+		{"GET", `{"result":"r2"}`},
+		{"PUT", `{"result":"r1"}`},
+		{"POST", `{"result":"primary"}`},
+	}
+
+	for i, test := range tests {
+		if got, _ := serve(test.meth, nil); got != test.expected {
+			t.Errorf("%d %s = %s; want %s", i, test.meth, got, test.expected)
+		}
+	}
+
+	_, w := serve("POST", nil)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultReadYourWritesCookie {
+		t.Fatalf("POST must set the %s cookie, got %v", DefaultReadYourWritesCookie, cookies)
+	}
+
+	if got, _ := serve("GET", cookies[0]); got != `{"result":"primary"}` {
+		t.Errorf("GET pinned to primary = %s; want %s", got, `{"result":"primary"}`)
+	}
+
+	if _, w := serve("GET", nil); len(w.Result().Cookies()) != 0 {
+		t.Errorf("GET must not set cookies")
+	}
+}
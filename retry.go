@@ -0,0 +1,178 @@
+package pj
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryPolicy is the policy for retrying calls of query functions that failed with a transient database error.
+//
+// Calls that have not been executed by the database, e.g. because of a serialization failure, a deadlock or
+// too many connections, are retried for all methods. Calls that failed because the connection was lost
+// are only retried for idempotent methods (GET, HEAD, PUT, DELETE) and for Stable and Immutable functions,
+// since the function may have been executed. If the retries are exhausted, the request is answered with
+// 503 Service Unavailable. Other database errors are answered with 500 Internal Server Error.
+//
+// The errTracker is called with a *RetryError for each failed call that is retried.
+type RetryPolicy struct {
+	// MaxRetries is the max number of retries, no retries if <= 0
+	MaxRetries int
+
+	// Backoff is the wait duration before the first retry. It is doubled for each further retry
+	// and randomized by up to 50 percent.
+	Backoff time.Duration
+
+	// MaxBackoff is the max wait duration between two retries
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy of a PJ without a RetryPolicy
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 2, Backoff: 50 * time.Millisecond, MaxBackoff: time.Second}
+
+// RetryError is passed to the errTracker for each failed call of a query function that is retried
+type RetryError struct {
+	Function string
+	Attempt  int // the number of the failed attempt, starting with 1
+	Err      error
+}
+
+func (r *RetryError) Error() string {
+	return fmt.Sprintf("retrying %s after attempt %d: %s", r.Function, r.Attempt, r.Err.Error())
+}
+
+func (r *RetryError) Unwrap() error { return r.Err }
+
+// the kinds of database errors
+const (
+	dbErrQuery       = iota // the query function failed or its result could not be scanned
+	dbErrNotExecuted        // transient error, the query function has not been executed
+	dbErrConnection         // the connection failed, the query function may have been executed
+)
+
+// notExecutedStates are the SQLSTATEs of transient errors, where the transaction has been rolled back
+// or the function has not been called at all
+var notExecutedStates = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P03": true, // cannot_connect_now
+	"08001": true, // sqlclient_unable_to_establish_sqlconnection
+	"08004": true, // sqlserver_rejected_establishment_of_sqlconnection
+}
+
+// dbErrorKind classifies the error that a Backend returned for the call of a query function
+func dbErrorKind(err error) int {
+	if pe := pgError(err); pe != nil {
+		switch {
+		case notExecutedStates[pe.Code]:
+			return dbErrNotExecuted
+		case strings.HasPrefix(pe.Code, "08"), pe.Code == "57P01", pe.Code == "57P02":
+			// connection_exception, admin_shutdown, crash_shutdown
+			return dbErrConnection
+		}
+		return dbErrQuery
+	}
+
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, context.DeadlineExceeded):
+		return dbErrConnection
+	}
+
+	// errors of drivers without an exported type, e.g. "conn is dead" or "connection refused"
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "connection") || strings.Contains(msg, "conn is") || strings.Contains(msg, "conn closed") {
+		return dbErrConnection
+	}
+	return dbErrQuery
+}
+
+// dbProblem returns the problem for an error of a Backend
+func (p *PJ) dbProblem(r *http.Request, err error) *Problem {
+	if dbErrorKind(err) != dbErrQuery {
+		return newProblem(http.StatusServiceUnavailable, ErrDatabaseUnavailable, err)
+	}
+	if pe := pgError(err); pe != nil {
+		return p.pgProblem(r, pe)
+	}
+	return newProblem(http.StatusInternalServerError, ErrScan, err)
+}
+
+// idempotent reports whether a call of the query function for the method meth may be repeated
+func (p *PJ) idempotent(meth string) bool {
+	switch meth {
+	case "GET", "PUT", "DELETE":
+		return true
+	}
+	return p.readOnly(meth)
+}
+
+// retryPolicy returns the RetryPolicy of p
+func (p *PJ) retryPolicy() RetryPolicy {
+	if p.Retry != nil {
+		return *p.Retry
+	}
+	return DefaultRetryPolicy
+}
+
+// backoff returns the wait duration before the retry with the given number, starting with 1
+func (rp RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.Backoff
+	for i := 1; i < retry && (rp.MaxBackoff <= 0 || d < rp.MaxBackoff); i++ {
+		d *= 2
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// callPrimary calls the query function fn via the Backend of p and retries it according to the RetryPolicy.
+// It returns a problem, if the call failed.
+func (p *PJ) callPrimary(r *http.Request, meth, fn string, params []byte) ([]byte, error) {
+	rp := p.retryPolicy()
+	ctx := r.Context()
+
+	for attempt := 1; ; attempt++ {
+		result, err := p.backend().Call(ctx, fn, params)
+		if err == nil {
+			return result, nil
+		}
+
+		kind := dbErrorKind(err)
+		retry := attempt <= rp.MaxRetries && ctx.Err() == nil &&
+			(kind == dbErrNotExecuted || (kind == dbErrConnection && p.idempotent(meth)))
+
+		if !retry {
+			prob := p.dbProblem(r, err)
+			prob.Retries = attempt - 1
+			return nil, prob
+		}
+
+		if p.errTracker != nil {
+			p.errTracker(&RetryError{Function: fn, Attempt: attempt, Err: err}, r)
+		}
+
+		select {
+		case <-time.After(rp.backoff(attempt)):
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package pj
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seqBackend is a Backend that returns the given errors one after another and then the result
+type seqBackend struct {
+	sync.Mutex
+	errs  []error
+	calls int
+}
+
+func (b *seqBackend) Call(ctx context.Context, fn string, params []byte) ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.calls++
+	if len(b.errs) > 0 {
+		err := b.errs[0]
+		b.errs = b.errs[1:]
+		return nil, err
+	}
+	return []byte(`{"result":1}`), nil
+}
+
+func TestDbErrorKind(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{&PgError{Code: "40001", Err: errors.New("serialization failure")}, dbErrNotExecuted},
+		{&PgError{Code: "53300", Err: errors.New("too many connections")}, dbErrNotExecuted},
+		{&PgError{Code: "08006", Err: errors.New("connection failure")}, dbErrConnection},
+		{&PgError{Code: "57P01", Err: errors.New("admin shutdown")}, dbErrConnection},
+		{&PgError{Code: "P0001", Err: errors.New("raise exception")}, dbErrQuery},
+		{&PgError{Code: "XX000", Err: errors.New("plv8 error")}, dbErrQuery},
+		{io.ErrUnexpectedEOF, dbErrConnection},
+		{errors.New("conn is dead"), dbErrConnection},
+		{errors.New("can't scan into dest[0]"), dbErrQuery},
+	}
+
+	for _, test := range tests {
+		if got, want := dbErrorKind(test.err), test.expected; got != want {
+			t.Errorf("dbErrorKind(%v) = %v; want %v", test.err, got, want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	conflict := &PgError{Code: "40001", Err: errors.New("serialization failure")}
+	raised := &PgError{Code: "P0001", Err: errors.New("raise exception")}
+
+	tests := []struct {
+		method   string
+		errs     []error
+		status   int
+		code     string
+		calls    int
+		retried  int
+		retryAft string
+	}{
+		{"GET", []error{io.EOF, io.EOF}, http.StatusOK, "", 3, 2, ""},
+		{"GET", []error{io.EOF, io.EOF, io.EOF}, http.StatusServiceUnavailable, ErrDatabaseUnavailable, 3, 2, "1"},
+		{"POST", []error{io.EOF}, http.StatusServiceUnavailable, ErrDatabaseUnavailable, 1, 0, "1"},
+		{"POST", []error{conflict}, http.StatusOK, "", 2, 1, ""},
+		{"POST", []error{raised}, http.StatusInternalServerError, ErrQueryFailed, 1, 0, ""},
+	}
+
+	for _, test := range tests {
+		var (
+			b       = &seqBackend{errs: test.errs}
+			retried int
+			prob    *Problem
+		)
+
+		p := New(nil, map[string]string{"GET": "pj__r__get", "POST": "pj__r__post"}, func(err error, r *http.Request) {
+			switch e := err.(type) {
+			case *RetryError:
+				retried++
+			case *Problem:
+				prob = e
+			}
+		})
+		p.Backend = b
+		p.Retry = &RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}
+
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(test.method, "/x", strings.NewReader("{}")))
+
+		if got, want := w.Code, test.status; got != want {
+			t.Errorf("%s %v status = %v; want %v", test.method, test.errs, got, want)
+		}
+
+		if got, want := b.calls, test.calls; got != want {
+			t.Errorf("%s %v calls = %v; want %v", test.method, test.errs, got, want)
+		}
+
+		if got, want := retried, test.retried; got != want {
+			t.Errorf("%s %v retries = %v; want %v", test.method, test.errs, got, want)
+		}
+
+		if got, want := w.Header().Get("Retry-After"), test.retryAft; got != want {
+			t.Errorf("%s %v Retry-After = %#v; want %#v", test.method, test.errs, got, want)
+		}
+
+		if test.code == "" {
+			continue
+		}
+
+		if prob == nil {
+			t.Errorf("%s %v: no problem tracked", test.method, test.errs)
+			continue
+		}
+
+		if got, want := prob.Code, test.code; got != want {
+			t.Errorf("%s %v problem code = %#v; want %#v", test.method, test.errs, got, want)
+		}
+
+		if got, want := prob.Retries, test.retried; got != want {
+			t.Errorf("%s %v problem retries = %v; want %v", test.method, test.errs, got, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package pj
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Signature is the parameter type and the return type of the postgres function of a query function.
+//
+// With the default signature (params json) RETURNS text the result is stringified by the function.
+// jsonb params are passed to plv8 without being reparsed from text, and a json or jsonb
+// return type lets the function return the response object without JSON.stringify.
+// The Signature is set per QueryCollection and may be overridden per query function
+// via the endpoint settings of the MountConfig, e.g.
+//
+//	{"endpoints": {"GET": {"signature": {"params": "jsonb", "returns": "jsonb"}}}}
+//
+// If the signature of a deployed function changes, the function is dropped and recreated on the next deployment.
+// The Backends pass and scan the types that match the signature, see package github.com/go-on/pj/pjpgx.
+type Signature struct {
+	Params  string `json:"params"`  // "json" (default) or "jsonb"
+	Returns string `json:"returns"` // "text" (default), "json" or "jsonb"
+}
+
+// DefaultSignature is the signature of the query functions if none is set
+var DefaultSignature = Signature{Params: "json", Returns: "text"}
+
+// withDefaults returns the signature with the empty types set to the ones of the DefaultSignature
+func (s Signature) withDefaults() Signature {
+	if s.Params == "" {
+		s.Params = DefaultSignature.Params
+	}
+	if s.Returns == "" {
+		s.Returns = DefaultSignature.Returns
+	}
+	return s
+}
+
+// override returns s with the types that are set in o
+func (s Signature) override(o *Signature) Signature {
+	if o == nil {
+		return s
+	}
+	if o.Params != "" {
+		s.Params = o.Params
+	}
+	if o.Returns != "" {
+		s.Returns = o.Returns
+	}
+	return s
+}
+
+func (s Signature) validate() error {
+	s = s.withDefaults()
+	switch s.Params {
+	case "json", "jsonb":
+	default:
+		return errors.New("invalid params type " + s.Params + ", must be json or jsonb")
+	}
+	switch s.Returns {
+	case "text", "json", "jsonb":
+	default:
+		return errors.New("invalid return type " + s.Returns + ", must be text, json or jsonb")
+	}
+	return nil
+}
+
+// declaration returns the declaration of the postgres function fn with the signature
+func (s Signature) declaration(fn string) string {
+	s = s.withDefaults()
+	return fmt.Sprintf("%s(params %s) RETURNS %s", fn, s.Params, s.Returns)
+}
+
+// Sql returns the sql that creates or replaces the postgres function for the query function fname
+// that is served for the request method meth. fbody is the content of the query function file.
+// The attributes of the function are taken from the FuncHeader of the file, an invalid header is ignored.
+// Without a volatility the function is STABLE for GET and VOLATILE for the other methods.
+// The function has no require function for the modules of the LibDir.
+func (s Signature) Sql(meth, fname string, fbody []byte) string {
+	h, _ := parseHeader(fbody)
+	return s.sql(meth, fname, fbody, h, nil)
+}
+
+// sql is like Sql but takes the attributes from the given FuncHeader h and
+// declares the require function for the modules with the given versions
+func (s Signature) sql(meth, fname string, fbody []byte, h *FuncHeader, versions map[string]string) string {
+	fn := FuncName(meth, fname)
+	stmt := fmt.Sprintf(`
+CREATE OR REPLACE FUNCTION %s AS $function$%s$function$ LANGUAGE plv8 %s;
+`, s.declaration(fn), s.funcSource(fbody, versions), h.attributes(meth))
+	if h != nil && h.Role != "" {
+		stmt += fmt.Sprintf("ALTER FUNCTION %s(params %s) OWNER TO %s;\n", fn, s.withDefaults().Params, h.Role)
+	}
+	return stmt
+}
+
+// FuncSource returns the source of the postgres function as it is stored in pg_proc.prosrc
+// for the given content of a query function file
+func (s Signature) FuncSource(fbody []byte) string {
+	return s.funcSource(fbody, nil)
+}
+
+// funcSource is like FuncSource but declares the require function for the modules with the given versions
+func (s Signature) funcSource(fbody []byte, versions map[string]string) string {
+	ret := "JSON.stringify(response)"
+	if s.withDefaults().Returns != "text" {
+		ret = "response"
+	}
+	return fmt.Sprintf(`
+	if (typeof params != 'object')
+		return NULL;
+  
+  var response = {};
+  response["http_status_code"] = 200;
+	response["results"] = [];
+	%s
+  return %s;
+%s
+`, string(fbody), ret, requireFunc(versions))
+}
+
+// dropFuncs returns the sql that drops the postgres functions with the name fn in the current schema,
+// i.e. the one the functions are created in, except the one with the signature keep, if keep is not nil
+func dropFuncs(fn string, keep *Signature) string {
+	cond := ""
+	if keep != nil {
+		k := keep.withDefaults()
+		cond = fmt.Sprintf(" AND (pg_get_function_identity_arguments(oid) <> 'params %s' OR prorettype <> '%s'::regtype)", k.Params, k.Returns)
+	}
+	return fmt.Sprintf(`DO $drop$ DECLARE f regprocedure; BEGIN
+	FOR f IN SELECT oid::regprocedure FROM pg_proc WHERE proname = %s AND pronamespace = current_schema()::regnamespace%s LOOP
+		EXECUTE 'DROP FUNCTION ' || f;
+	END LOOP;
+END $drop$;`, quoteLiteral(fn), cond)
+}
+
+// signature returns the Signature of the query function for the method meth of the mount path mntp
+// with the FuncHeader h of its file
+func (q *QueryCollection) signature(mntp, meth string, h *FuncHeader) (Signature, error) {
+	s := q.Signature.withDefaults()
+	if q.FS == nil {
+		return s, s.validate()
+	}
+
+	c, err := readMountConfig(q.FS, mntp)
+	if err != nil {
+		return s, err
+	}
+	if c != nil {
+		if e, has := c.Endpoints[strings.ToUpper(meth)]; has && e != nil {
+			s = s.override(e.Signature)
+		}
+	}
+	if h != nil {
+		s = s.override(h.Signature)
+	}
+	return s, s.validate()
+}